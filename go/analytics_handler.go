@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const retentionBucketSeconds = 60
+
+type RetentionBucket struct {
+	// 配信開始からの経過分
+	Minute  int64 `json:"minute"`
+	StartAt int64 `json:"start_at"`
+	// この1分間に視聴していたユーザの数
+	Viewers      int64 `json:"viewers"`
+	Joins        int64 `json:"joins"`
+	Leaves       int64 `json:"leaves"`
+	Livecomments int64 `json:"livecomments"`
+	Reactions    int64 `json:"reactions"`
+	// この1分間に投げられたチップの合計額
+	Tips int64 `json:"tips"`
+}
+
+type LivestreamRetention struct {
+	LivestreamID  int64             `json:"livestream_id"`
+	StartAt       int64             `json:"start_at"`
+	EndAt         int64             `json:"end_at"`
+	BucketSeconds int64             `json:"bucket_seconds"`
+	Buckets       []RetentionBucket `json:"buckets"`
+}
+
+// 配信者向けの視聴維持率の分析API
+// 視聴記録・ライブコメント・リアクションを配信開始から1分ごとに集計する
+// GET /api/livestream/:livestream_id/analytics/retention
+func getLivestreamRetentionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't see analytics of other streamer's livestream")
+	}
+
+	// 配信中であれば現在時刻までを集計する
+	startAt := livestreamModel.StartAt
+	endAt := min(livestreamModel.EndAt, time.Now().Unix())
+	retention := LivestreamRetention{
+		LivestreamID:  livestreamModel.ID,
+		StartAt:       startAt,
+		EndAt:         endAt,
+		BucketSeconds: retentionBucketSeconds,
+		Buckets:       []RetentionBucket{},
+	}
+	if endAt <= startAt {
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, retention)
+	}
+
+	buckets := make([]RetentionBucket, (endAt-startAt+retentionBucketSeconds-1)/retentionBucketSeconds)
+	for i := range buckets {
+		buckets[i].Minute = int64(i)
+		buckets[i].StartAt = startAt + int64(i)*retentionBucketSeconds
+	}
+	// 配信時間外の時刻は最初か最後の1分にまとめる
+	bucketIndex := func(t int64) int {
+		return int(min(max(t-startAt, 0)/retentionBucketSeconds, int64(len(buckets)-1)))
+	}
+
+	var watchLogModels []*WatchLogModel
+	if err := tx.SelectContext(ctx, &watchLogModels, "SELECT * FROM watch_logs WHERE livestream_id = ? AND entered_at < ? ORDER BY user_id, entered_at", livestreamModel.ID, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch logs: "+err.Error())
+	}
+	// 同じユーザの視聴記録が重なっても1人として数えるため、ユーザごとに数え終えた位置を覚えておく
+	var currentUserID int64
+	countedUntil := -1
+	for _, watchLogModel := range watchLogModels {
+		if watchLogModel.ExitedAt != 0 && watchLogModel.ExitedAt <= startAt {
+			continue
+		}
+		if watchLogModel.UserID != currentUserID {
+			currentUserID = watchLogModel.UserID
+			countedUntil = -1
+		}
+
+		from := bucketIndex(watchLogModel.EnteredAt)
+		buckets[from].Joins++
+		// 退室していなければ集計の終わりまで視聴していたものとする
+		to := len(buckets) - 1
+		if watchLogModel.ExitedAt != 0 && watchLogModel.ExitedAt < endAt {
+			to = bucketIndex(watchLogModel.ExitedAt)
+			buckets[to].Leaves++
+		}
+		for i := max(from, countedUntil+1); i <= to; i++ {
+			buckets[i].Viewers++
+		}
+		countedUntil = max(countedUntil, to)
+	}
+
+	var livecommentModels []*LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND created_at >= ? AND created_at < ?", livestreamModel.ID, startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	for _, livecommentModel := range livecommentModels {
+		bucket := &buckets[bucketIndex(livecommentModel.CreatedAt)]
+		bucket.Livecomments++
+		bucket.Tips += livecommentModel.Tip
+	}
+
+	var reactedAts []int64
+	if err := tx.SelectContext(ctx, &reactedAts, "SELECT created_at FROM reactions WHERE livestream_id = ? AND created_at >= ? AND created_at < ?", livestreamModel.ID, startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+	for _, reactedAt := range reactedAts {
+		buckets[bucketIndex(reactedAt)].Reactions++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	retention.Buckets = buckets
+	return c.JSON(http.StatusOK, retention)
+}
@@ -1,6 +1,10 @@
 package main
 
-import "context"
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
 
 type db interface {
 	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
@@ -65,12 +69,99 @@ func getTagById(ctx context.Context, tx db, tagId int64) (*TagModel, error) {
 		}
 		for _, tag := range tags {
 			tagsCache.Store(tag.ID, tag)
+			tagsByNameCache.Store(tag.Name, tag)
+		}
+		if len(tags) == 0 {
+			return nil, sql.ErrNoRows
 		}
 		tagModel = tags[0]
 	}
 	return &tagModel, nil
 }
 
+func getTagByName(ctx context.Context, tx db, name string) (*TagModel, error) {
+	tagModel := TagModel{}
+	cachedTagModel, ok := tagsByNameCache.Load(name)
+	if ok {
+		tagModel = cachedTagModel.(TagModel)
+	} else {
+		err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE name = ?", name)
+		if err != nil {
+			return nil, err
+		}
+		tagsCache.Store(tagModel.ID, tagModel)
+		tagsByNameCache.Store(tagModel.Name, tagModel)
+	}
+	return &tagModel, nil
+}
+
+// タグを全てキャッシュに載せる
+func loadTagsCache(ctx context.Context, tx db) error {
+	var tags []TagModel
+	if err := tx.SelectContext(ctx, &tags, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tagsCache.Store(tag.ID, tag)
+		tagsByNameCache.Store(tag.Name, tag)
+	}
+
+	var aliases []TagAliasModel
+	if err := tx.SelectContext(ctx, &aliases, "SELECT * FROM tag_aliases"); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		tagAliasesCache.Store(alias.Name, alias)
+	}
+	return nil
+}
+
+// タグ名または別名から正式なタグを取得する
+func getTagByNameOrAlias(ctx context.Context, tx db, name string) (*TagModel, error) {
+	tagModel, err := getTagByName(ctx, tx, name)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return tagModel, err
+	}
+
+	aliasModel := TagAliasModel{}
+	cachedAliasModel, ok := tagAliasesCache.Load(name)
+	if ok {
+		aliasModel = cachedAliasModel.(TagAliasModel)
+	} else {
+		err := tx.GetContext(ctx, &aliasModel, "SELECT * FROM tag_aliases WHERE name = ?", name)
+		if err != nil {
+			return nil, err
+		}
+		tagAliasesCache.Store(aliasModel.Name, aliasModel)
+	}
+	return getTagById(ctx, tx, aliasModel.TagID)
+}
+
+// タグ自身と、その子孫のタグのID
+func tagDescendantIDs(tagID int64) []int64 {
+	children := map[int64][]int64{}
+	tagsCache.Range(func(key, value interface{}) bool {
+		tagModel := value.(TagModel)
+		if tagModel.ParentID != 0 {
+			children[tagModel.ParentID] = append(children[tagModel.ParentID], tagModel.ID)
+		}
+		return true
+	})
+
+	tagIDs := []int64{tagID}
+	visited := map[int64]bool{tagID: true}
+	for i := 0; i < len(tagIDs); i++ {
+		for _, childID := range children[tagIDs[i]] {
+			if visited[childID] {
+				continue
+			}
+			visited[childID] = true
+			tagIDs = append(tagIDs, childID)
+		}
+	}
+	return tagIDs
+}
+
 func getLivestream(ctx context.Context, tx db, livestreamID int) (*LivestreamModel, error) {
 	livestreamModel := LivestreamModel{}
 	livestream, ok := livestreamCache.Load(livestreamID)
@@ -86,3 +177,12 @@ func getLivestream(ctx context.Context, tx db, livestreamID int) (*LivestreamMod
 
 	return &livestreamModel, nil
 }
+
+// 配信の内容が変わった際に、配信に紐づくキャッシュを破棄する
+func evictLivestreamCache(livestreamID int64) {
+	livestreamCache.Delete(int(livestreamID))
+	livestreamTagsCache.Delete(livestreamID)
+	livestreamCollaboratorsCache.Delete(livestreamID)
+	livestreamVariantsCache.Delete(livestreamID)
+	livestreamInviteesCache.Delete(livestreamID)
+}
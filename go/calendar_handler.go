@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	icsTimeFormat = "20060102T150405Z"
+	// RFC 5545 3.1: 1行は改行を除いて75オクテットまで
+	icsMaxLineOctets = 75
+)
+
+// 配信者の配信予定をiCalendar形式で取得するAPI
+// カレンダーアプリから購読できるように、セッションは不要
+// GET /api/user/:username/livestream.ics
+func getUserLivestreamsCalendarHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	user, err := getUserByName(ctx, tx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	// キャンセルされた配信もSTATUS:CANCELLEDとして配信し、購読側の予定を取り消せるようにする
+	visibilityCondition, visibilityParams := listableLivestreamCondition("livestreams", getSessionUserID(c))
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND "+visibilityCondition+" ORDER BY start_at", append([]interface{}{user.ID}, visibilityParams...)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.Name
+	}
+	calendar := buildLivestreamCalendar(displayName+"の配信予定", livestreams, time.Now())
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(calendar))
+}
+
+// 配信一覧からRFC 5545形式のカレンダーを組み立てる
+func buildLivestreamCalendar(name string, livestreams []Livestream, now time.Time) string {
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//ISUPipe//Livestream Schedule//JA")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:"+escapeICSText(name))
+
+	dtstamp := now.UTC().Format(icsTimeFormat)
+	for _, livestream := range livestreams {
+		categories := make([]string, len(livestream.Tags))
+		for i, tag := range livestream.Tags {
+			categories[i] = escapeICSText(tag.Name)
+		}
+		status := "CONFIRMED"
+		if livestream.Status == livestreamStatusCanceled {
+			status = "CANCELLED"
+		}
+
+		writeICSLine(&b, "BEGIN:VEVENT")
+		// UIDは配信IDから決まるので、リスケジュールやキャンセルしても同じ予定として扱われる
+		writeICSLine(&b, fmt.Sprintf("UID:livestream-%d@isupipe", livestream.ID))
+		writeICSLine(&b, "DTSTAMP:"+dtstamp)
+		writeICSLine(&b, "DTSTART:"+time.Unix(livestream.StartAt, 0).UTC().Format(icsTimeFormat))
+		writeICSLine(&b, "DTEND:"+time.Unix(livestream.EndAt, 0).UTC().Format(icsTimeFormat))
+		writeICSLine(&b, "SUMMARY:"+escapeICSText(livestream.Title))
+		if livestream.Description != "" {
+			writeICSLine(&b, "DESCRIPTION:"+escapeICSText(livestream.Description))
+		}
+		if len(categories) != 0 {
+			writeICSLine(&b, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		writeICSLine(&b, "STATUS:"+status)
+		writeICSLine(&b, "END:VEVENT")
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// RFC 5545 3.3.11: TEXT型の値のエスケープ
+func escapeICSText(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, ";", `\;`)
+	s = strings.ReplaceAll(s, ",", `\,`)
+	s = strings.ReplaceAll(s, "\r\n", `\n`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return s
+}
+
+// 75オクテットを超える行は、マルチバイト文字の途中で切らないように折り返す
+func writeICSLine(b *strings.Builder, line string) {
+	limit := icsMaxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// 継続行は先頭の空白1オクテットを含めて75オクテットまで
+		limit = icsMaxLineOctets - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
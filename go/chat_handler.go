@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	chatMessageLivecomment = "livecomment"
+	chatMessageReaction    = "reaction"
+	chatMessageAck         = "ack"
+	chatMessageError       = "error"
+)
+
+const (
+	// クライアントから受け取るメッセージの上限
+	chatMaxMessageBytes = 64 << 10
+	// この時間内に送信できないクライアントは切断する
+	chatWriteTimeout = 10 * time.Second
+)
+
+// クライアントからの投稿
+type ChatClientMessage struct {
+	// livecomment または reaction
+	Type string `json:"type"`
+	// ack/errorにそのまま付けて返す
+	RequestID string `json:"request_id"`
+	Comment   string `json:"comment"`
+	Tip       int64  `json:"tip"`
+	EmojiName string `json:"emoji_name"`
+}
+
+// 配信のイベント (SSEと同じ種類) と、投稿に対するack/error
+type ChatServerMessage struct {
+	Type      string          `json:"type"`
+	EventID   int64           `json:"event_id,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Message   string          `json:"message,omitempty"`
+}
+
+// 配信ごとのチャットルームに参加するWebSocket API
+// ルームのライブコメント・リアクションを受け取り、同じ接続で投稿もできる
+// イベントはこのホストのlivestreamEventsからのみ届くので、1台で動かすことを前提にしている
+// 複数台で動かす場合は、同じ配信への投稿と接続を同じホストに振り分けること
+// GET /api/livestream/:livestream_id/chat
+func getLivestreamChatHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, err := getViewableLivestream(ctx, dbConn, livestreamID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	logger := c.Logger()
+	server := websocket.Server{
+		Handshake: checkChatOrigin,
+		Handler: func(ws *websocket.Conn) {
+			serveLivestreamChat(ws, logger, userID, livestreamModel.ID)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// セッションはCookieで確認するので、他のサイトのページからの接続は拒否する
+// Originを送らないボットなどのクライアントは許可する
+func checkChatOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != req.Host {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func serveLivestreamChat(ws *websocket.Conn, logger echo.Logger, userID, livestreamID int64) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = chatMaxMessageBytes
+
+	_, events := livestreamEvents.Subscribe(livestreamID, -1)
+	defer livestreamEvents.Unsubscribe(livestreamID, events)
+
+	// 投稿は1件ずつ処理し、結果を書き込むまで次のメッセージを読まない
+	replies := make(chan ChatServerMessage)
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(readerDone)
+		for {
+			var b []byte
+			if err := websocket.Message.Receive(ws, &b); err != nil {
+				return
+			}
+			reply := handleChatClientMessage(ws.Request(), logger, userID, livestreamID, b)
+			select {
+			case replies <- reply:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg ChatServerMessage
+		select {
+		case <-readerDone:
+			return
+		case event, ok := <-events:
+			if !ok {
+				// 追いつけないクライアントはハブから外されるので切断する
+				return
+			}
+			msg = ChatServerMessage{Type: event.Type, EventID: event.ID, Data: event.Data}
+		case msg = <-replies:
+		}
+		if err := sendChatMessage(ws, msg); err != nil {
+			return
+		}
+	}
+}
+
+func handleChatClientMessage(req *http.Request, logger echo.Logger, userID, livestreamID int64, b []byte) ChatServerMessage {
+	var msg ChatClientMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return ChatServerMessage{Type: chatMessageError, Message: "failed to decode the message as json"}
+	}
+
+	var created interface{}
+	var err error
+	switch msg.Type {
+	case chatMessageLivecomment:
+		created, err = createLivecomment(req.Context(), logger, userID, int(livestreamID), &PostLivecommentRequest{
+			Comment: msg.Comment,
+			Tip:     msg.Tip,
+		})
+	case chatMessageReaction:
+		created, err = createReaction(req.Context(), logger, userID, int(livestreamID), &PostReactionRequest{
+			EmojiName: msg.EmojiName,
+		})
+	default:
+		err = echo.NewHTTPError(http.StatusBadRequest, "unknown message type")
+	}
+	if err != nil {
+		return ChatServerMessage{Type: chatMessageError, RequestID: msg.RequestID, Message: chatErrorMessage(err)}
+	}
+
+	data, err := json.Marshal(created)
+	if err != nil {
+		return ChatServerMessage{Type: chatMessageError, RequestID: msg.RequestID, Message: "failed to encode the response: " + err.Error()}
+	}
+	return ChatServerMessage{Type: chatMessageAck, RequestID: msg.RequestID, Data: data}
+}
+
+func chatErrorMessage(err error) string {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return fmt.Sprint(he.Message)
+	}
+	return err.Error()
+}
+
+func sendChatMessage(ws *websocket.Conn, msg ChatServerMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := ws.SetWriteDeadline(time.Now().Add(chatWriteTimeout)); err != nil {
+		return err
+	}
+	return websocket.Message.Send(ws, string(b))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	collaboratorStatusPending  = "pending"
+	collaboratorStatusAccepted = "accepted"
+	collaboratorStatusDeclined = "declined"
+)
+
+type LivestreamCollaboratorModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+type LivestreamCollaborator struct {
+	User      User   `json:"user"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type CollaborationInvitation struct {
+	Livestream Livestream `json:"livestream"`
+	Status     string     `json:"status"`
+	CreatedAt  int64      `json:"created_at"`
+	UpdatedAt  int64      `json:"updated_at"`
+}
+
+// 配信のコラボレーター一覧取得API (招待中・辞退済みも含む)
+// GET /api/livestream/:livestream_id/collaborators
+func getLivestreamCollaboratorsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getViewableLivestream(ctx, tx, livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var collaboratorModels []*LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+
+	collaborators := make([]LivestreamCollaborator, len(collaboratorModels))
+	for i := range collaboratorModels {
+		userModel, err := getUserById(ctx, tx, collaboratorModels[i].UserID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		user, err := fillUserResponse(ctx, tx, *userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		collaborators[i] = LivestreamCollaborator{
+			User:      user,
+			Status:    collaboratorModels[i].Status,
+			CreatedAt: collaboratorModels[i].CreatedAt,
+			UpdatedAt: collaboratorModels[i].UpdatedAt,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, collaborators)
+}
+
+// 自分宛てのコラボ招待一覧取得API
+// GET /api/user/me/collaborations
+func getMyCollaborationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var collaboratorModels []*LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, "SELECT * FROM livestream_collaborators WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+
+	invitations := make([]CollaborationInvitation, len(collaboratorModels))
+	for i := range collaboratorModels {
+		livestreamModel, err := getLivestream(ctx, tx, int(collaboratorModels[i].LivestreamID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		invitations[i] = CollaborationInvitation{
+			Livestream: livestream,
+			Status:     collaboratorModels[i].Status,
+			CreatedAt:  collaboratorModels[i].CreatedAt,
+			UpdatedAt:  collaboratorModels[i].UpdatedAt,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+// コラボ招待の承諾API
+// POST /api/livestream/:livestream_id/collaborators/accept
+func acceptCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusAccepted)
+}
+
+// コラボ招待の辞退API
+// POST /api/livestream/:livestream_id/collaborators/decline
+func declineCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusDeclined)
+}
+
+func respondCollaboration(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// キャンセル・早期終了と同時に承諾されないよう、配信の行ロックを取ってから確認する
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not invited to the livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var collaboratorModel LivestreamCollaboratorModel
+	if err := tx.GetContext(ctx, &collaboratorModel, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? FOR UPDATE", livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not invited to the livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborator: "+err.Error())
+	}
+	if collaboratorModel.Status != collaboratorStatusPending {
+		return echo.NewHTTPError(http.StatusBadRequest, "the invitation has already been "+collaboratorModel.Status)
+	}
+	// 辞退は、キャンセル・終了した配信の招待でもできる
+	now := time.Now().Unix()
+	if status == collaboratorStatusAccepted {
+		if livestreamModel.CanceledAt != 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't accept the invitation to the canceled livestream")
+		}
+		if livestreamModel.EndAt <= now {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't accept the invitation to the ended livestream")
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_collaborators SET status = ?, updated_at = ? WHERE id = ?", status, now, collaboratorModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	livestreamCollaboratorsCache.Delete(int64(livestreamID))
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 配信予約時に指定されたユーザを招待する
+func inviteLivestreamCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, userIDs []int64) error {
+	now := time.Now().Unix()
+	for _, userID := range userIDs {
+		if userID == livestreamModel.UserID {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't invite yourself as a collaborator")
+		}
+		if _, err := getUserById(ctx, tx, userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("collaborator %d not found", userID))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		collaboratorModel := LivestreamCollaboratorModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			Status:       collaboratorStatusPending,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_collaborators (livestream_id, user_id, status, created_at, updated_at) VALUES (:livestream_id, :user_id, :status, :created_at, :updated_at)", collaboratorModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream collaborator: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// 招待を承諾したコラボレーターのユーザIDを取得する
+func getAcceptedCollaboratorIDs(ctx context.Context, tx db, livestreamID int64) ([]int64, error) {
+	if cached, ok := livestreamCollaboratorsCache.Load(livestreamID); ok {
+		return cached.([]int64), nil
+	}
+
+	userIDs := []int64{}
+	if err := tx.SelectContext(ctx, &userIDs, "SELECT user_id FROM livestream_collaborators WHERE livestream_id = ? AND status = ? ORDER BY id", livestreamID, collaboratorStatusAccepted); err != nil {
+		return nil, err
+	}
+	livestreamCollaboratorsCache.Store(livestreamID, userIDs)
+	return userIDs, nil
+}
+
+// 配信者本人と、招待を承諾したコラボレーターはモデレーションできる
+func canModerateLivestream(ctx context.Context, tx db, livestreamModel *LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+	collaboratorIDs, err := getAcceptedCollaboratorIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, collaboratorID := range collaboratorIDs {
+		if collaboratorID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 接続が切れたときにクライアントが再接続するまでのミリ秒
+	eventStreamRetryMillis = 3000
+	// プロキシに切断されないよう、イベントがなくてもコメント行を送る間隔
+	eventStreamKeepAliveInterval = 15 * time.Second
+)
+
+// ライブコメント・リアクション・モデレーションをServer-Sent Eventsで配信するAPI
+// 再接続時はLast-Event-ID (またはlast_event_idクエリ) より後のイベントから再送する
+// イベントとそのIDはこのホストのlivestreamEventsで管理しているので、1台で動かすことを前提にしている
+// 複数台で動かす場合は、同じ配信への投稿と接続を同じホストに振り分けること
+// GET /api/livestream/:livestream_id/events
+func getLivestreamEventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	lastEventID := int64(-1)
+	lastEventIDParam := c.Request().Header.Get("Last-Event-ID")
+	if lastEventIDParam == "" {
+		lastEventIDParam = c.QueryParam("last_event_id")
+	}
+	if lastEventIDParam != "" {
+		lastEventID, err = strconv.ParseInt(lastEventIDParam, 10, 64)
+		if err != nil || lastEventID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID must be non-negative integer")
+		}
+	}
+
+	livestreamModel, err := getViewableLivestream(ctx, dbConn, livestreamID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	backlog, events := livestreamEvents.Subscribe(livestreamModel.ID, lastEventID)
+	defer livestreamEvents.Unsubscribe(livestreamModel.ID, events)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(res, "retry: %d\n\n", eventStreamRetryMillis); err != nil {
+		return nil
+	}
+	for _, event := range backlog {
+		if err := writeLivestreamEvent(res, event); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				// 追いつけずに切断された。クライアントはLast-Event-IDで再接続する
+				return nil
+			}
+			if err := writeLivestreamEvent(res, event); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func writeLivestreamEvent(res *echo.Response, event LivestreamEvent) error {
+	_, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
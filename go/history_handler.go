@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 入室から退室までの視聴の記録。削除せず、退室時にexited_atだけを埋める
+type WatchLogModel struct {
+	ID           int64 `db:"id"`
+	UserID       int64 `db:"user_id"`
+	LivestreamID int64 `db:"livestream_id"`
+	EnteredAt    int64 `db:"entered_at"`
+	// 0の場合はまだ退室していない
+	ExitedAt int64 `db:"exited_at"`
+}
+
+type WatchHistoryEntry struct {
+	ID         int64      `json:"id"`
+	Livestream Livestream `json:"livestream"`
+	EnteredAt  int64      `json:"entered_at"`
+	ExitedAt   int64      `json:"exited_at,omitempty"`
+	// 視聴した秒数
+	WatchDuration int64 `json:"watch_duration"`
+}
+
+// 自分の視聴履歴の取得API (新しい順)
+// GET /api/user/me/history?cursor=&limit=
+func getMyWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		page = &pageRequest{Limit: defaultPageSize}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 消去した時点までの履歴は返さない
+	clearedID, err := getWatchHistoryClearedID(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+
+	query := "SELECT * FROM watch_logs WHERE user_id = ? AND id > ?"
+	params := []interface{}{userID, clearedID}
+	pageCondition, pageParams := page.idCondition("id")
+	query += pageCondition + " ORDER BY id DESC LIMIT ?"
+	params = append(params, pageParams...)
+	params = append(params, page.fetchLimit())
+
+	var watchLogModels []*WatchLogModel
+	if err := tx.SelectContext(ctx, &watchLogModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+
+	n, nextCursor := page.paginateByID(len(watchLogModels), func(i int) int64 { return watchLogModels[i].ID })
+	watchLogModels = watchLogModels[:n]
+
+	now := time.Now().Unix()
+	entries := make([]WatchHistoryEntry, 0, len(watchLogModels))
+	for _, watchLogModel := range watchLogModels {
+		// 後から非公開になって見られなくなった配信は除く
+		livestreamModel, err := getViewableLivestream(ctx, tx, int(watchLogModel.LivestreamID), userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		entries = append(entries, WatchHistoryEntry{
+			ID:            watchLogModel.ID,
+			Livestream:    livestream,
+			EnteredAt:     watchLogModel.EnteredAt,
+			ExitedAt:      watchLogModel.ExitedAt,
+			WatchDuration: watchDuration(watchLogModel, livestreamModel, now),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Page[WatchHistoryEntry]{Items: entries, NextCursor: nextCursor})
+}
+
+// 自分の視聴履歴の消去API
+// 記録そのものは残し、消去した時点より前の履歴を返さないようにする
+// DELETE /api/user/me/history
+func clearMyWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var lastID int64
+	if err := tx.GetContext(ctx, &lastID, "SELECT IFNULL(MAX(id), 0) FROM watch_logs WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO watch_history_clears (user_id, cleared_id, cleared_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE cleared_id = GREATEST(cleared_id, VALUES(cleared_id)), cleared_at = VALUES(cleared_at)", userID, lastID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to clear watch history: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func insertWatchLog(ctx context.Context, tx *sqlx.Tx, userID, livestreamID, now int64) error {
+	watchLogModel := WatchLogModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		EnteredAt:    now,
+	}
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO watch_logs (user_id, livestream_id, entered_at) VALUES (:user_id, :livestream_id, :entered_at)", watchLogModel)
+	return err
+}
+
+// 退室していない記録を全て閉じる
+func closeWatchLogs(ctx context.Context, tx *sqlx.Tx, userID, livestreamID, now int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE watch_logs SET exited_at = ? WHERE user_id = ? AND livestream_id = ? AND exited_at = 0", now, userID, livestreamID)
+	return err
+}
+
+// 履歴を消去した時点の最後の視聴記録のID (消去していなければ0)
+// これ以下のIDの視聴記録は履歴としてもおすすめとしても使わない
+func getWatchHistoryClearedID(ctx context.Context, tx db, userID int64) (int64, error) {
+	var clearedID int64
+	if err := tx.GetContext(ctx, &clearedID, "SELECT cleared_id FROM watch_history_clears WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return clearedID, nil
+}
+
+// 退室していなければ、配信の終了時刻か現在時刻までを視聴したものとする
+func watchDuration(watchLogModel *WatchLogModel, livestreamModel *LivestreamModel, now int64) int64 {
+	exitedAt := watchLogModel.ExitedAt
+	if exitedAt == 0 {
+		exitedAt = min(now, livestreamModel.EndAt)
+	}
+	return max(exitedAt-watchLogModel.EnteredAt, 0)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	hlsPlaylistTypeMaster = "master"
+	hlsPlaylistTypeMedia  = "media"
+)
+
+// RFC 8216で定義されたHLSのプレイリスト
+// マスタープレイリストの場合はVariantsを、メディアプレイリストの場合はTargetDurationとSegmentsを持つ
+type hlsPlaylist struct {
+	Type           string
+	Variants       []hlsVariant
+	TargetDuration int64
+	Segments       int
+}
+
+type hlsVariant struct {
+	Bandwidth        int64
+	AverageBandwidth int64
+	Width            int64
+	Height           int64
+	Codecs           string
+	URI              string
+}
+
+// マスタープレイリストまたはメディアプレイリストとして読み込む
+// 必須のタグが欠けている場合や、両方の種類のタグが混在している場合はエラーを返す
+func parseHLSPlaylist(r io.Reader) (*hlsPlaylist, error) {
+	scanner := bufio.NewScanner(r)
+	playlist := &hlsPlaylist{}
+
+	header := false
+	// 直前の#EXT-X-STREAM-INFまたは#EXTINFに対応するURIを待っているか
+	var pendingVariant *hlsVariant
+	pendingSegment := false
+	hasTargetDuration := false
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, errors.New("playlist must start with #EXTM3U")
+			}
+			header = true
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			if err := playlist.setType(hlsPlaylistTypeMaster); err != nil {
+				return nil, err
+			}
+			variant, err := parseHLSVariant(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			pendingVariant = variant
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if err := playlist.setType(hlsPlaylistTypeMedia); err != nil {
+				return nil, err
+			}
+			targetDuration, err := strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 10, 64)
+			if err != nil || targetDuration < 0 {
+				return nil, fmt.Errorf("line %d: invalid #EXT-X-TARGETDURATION", lineNo)
+			}
+			playlist.TargetDuration = targetDuration
+			hasTargetDuration = true
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if err := playlist.setType(hlsPlaylistTypeMedia); err != nil {
+				return nil, err
+			}
+			duration, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if _, err := strconv.ParseFloat(duration, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid #EXTINF duration", lineNo)
+			}
+			pendingSegment = true
+		case strings.HasPrefix(line, "#"):
+			// その他のタグとコメントは読み飛ばす
+		default:
+			switch {
+			case pendingVariant != nil:
+				pendingVariant.URI = line
+				playlist.Variants = append(playlist.Variants, *pendingVariant)
+				pendingVariant = nil
+			case pendingSegment:
+				playlist.Segments++
+				pendingSegment = false
+			default:
+				return nil, fmt.Errorf("line %d: URI without #EXT-X-STREAM-INF or #EXTINF", lineNo)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !header {
+		return nil, errors.New("playlist is empty")
+	}
+	if pendingVariant != nil || pendingSegment {
+		return nil, errors.New("playlist ends without URI")
+	}
+	switch playlist.Type {
+	case hlsPlaylistTypeMaster:
+		return playlist, nil
+	case hlsPlaylistTypeMedia:
+		if !hasTargetDuration {
+			return nil, errors.New("media playlist must have #EXT-X-TARGETDURATION")
+		}
+		return playlist, nil
+	}
+	return nil, errors.New("playlist has neither variants nor segments")
+}
+
+func (p *hlsPlaylist) setType(playlistType string) error {
+	if p.Type != "" && p.Type != playlistType {
+		return errors.New("playlist mixes master and media playlist tags")
+	}
+	p.Type = playlistType
+	return nil
+}
+
+// #EXT-X-STREAM-INFの属性リストを読む
+func parseHLSVariant(attributes string) (*hlsVariant, error) {
+	attrs, err := parseHLSAttributes(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	variant := &hlsVariant{}
+	bandwidth, ok := attrs["BANDWIDTH"]
+	if !ok {
+		return nil, errors.New("#EXT-X-STREAM-INF must have BANDWIDTH")
+	}
+	if variant.Bandwidth, err = strconv.ParseInt(bandwidth, 10, 64); err != nil {
+		return nil, errors.New("invalid BANDWIDTH")
+	}
+	if v, ok := attrs["AVERAGE-BANDWIDTH"]; ok {
+		if variant.AverageBandwidth, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("invalid AVERAGE-BANDWIDTH")
+		}
+	}
+	if v, ok := attrs["RESOLUTION"]; ok {
+		width, height, found := strings.Cut(v, "x")
+		if !found {
+			return nil, errors.New("invalid RESOLUTION")
+		}
+		if variant.Width, err = strconv.ParseInt(width, 10, 64); err != nil {
+			return nil, errors.New("invalid RESOLUTION")
+		}
+		if variant.Height, err = strconv.ParseInt(height, 10, 64); err != nil {
+			return nil, errors.New("invalid RESOLUTION")
+		}
+	}
+	variant.Codecs = attrs["CODECS"]
+	return variant, nil
+}
+
+// NAME=VALUEのカンマ区切り。VALUEはダブルクォートで囲まれていればカンマを含められる
+func parseHLSAttributes(s string) (map[string]string, error) {
+	attrs := map[string]string{}
+	for len(s) > 0 {
+		name, rest, found := strings.Cut(s, "=")
+		if !found || name == "" {
+			return nil, errors.New("invalid attribute list")
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, errors.New("unterminated quoted string in attribute list")
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+		attrs[strings.TrimSpace(name)] = value
+
+		if rest == "," || rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, ",") {
+			return nil, errors.New("invalid attribute list")
+		}
+		s = rest[1:]
+	}
+	return attrs, nil
+}
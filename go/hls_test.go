@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseHLSPlaylist(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    *hlsPlaylist
+	}{
+		{
+			fixture: "master.m3u8",
+			want: &hlsPlaylist{
+				Type: hlsPlaylistTypeMaster,
+				Variants: []hlsVariant{
+					{Bandwidth: 5000000, AverageBandwidth: 4500000, Width: 1920, Height: 1080, Codecs: "avc1.640028,mp4a.40.2", URI: "1080p/index.m3u8"},
+					{Bandwidth: 2800000, Width: 1280, Height: 720, Codecs: "avc1.4d401f,mp4a.40.2", URI: "720p/index.m3u8"},
+					{Bandwidth: 64000, Codecs: "mp4a.40.5", URI: "audio/index.m3u8"},
+				},
+			},
+		},
+		{
+			fixture: "media.m3u8",
+			want: &hlsPlaylist{
+				Type:           hlsPlaylistTypeMedia,
+				TargetDuration: 6,
+				Segments:       3,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got, err := parseHLSPlaylist(openHLSFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHLSPlaylistMalformed(t *testing.T) {
+	tests := []struct {
+		fixture string
+		wantErr string
+	}{
+		{fixture: "empty.m3u8", wantErr: "playlist is empty"},
+		{fixture: "missing_header.m3u8", wantErr: "playlist must start with #EXTM3U"},
+		{fixture: "mixed.m3u8", wantErr: "playlist mixes master and media playlist tags"},
+		{fixture: "media_without_target_duration.m3u8", wantErr: "media playlist must have #EXT-X-TARGETDURATION"},
+		{fixture: "variant_without_uri.m3u8", wantErr: "playlist ends without URI"},
+		{fixture: "variant_without_bandwidth.m3u8", wantErr: "line 2: #EXT-X-STREAM-INF must have BANDWIDTH"},
+		{fixture: "uri_without_tag.m3u8", wantErr: "line 3: URI without #EXT-X-STREAM-INF or #EXTINF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			_, err := parseHLSPlaylist(openHLSFixture(t, tt.fixture))
+			if err == nil {
+				t.Fatalf("expected error %q", tt.wantErr)
+			}
+			if err.Error() != tt.wantErr {
+				t.Fatalf("got error %q, want %q", err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseHLSVariant(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes string
+		want       *hlsVariant
+		wantErr    bool
+	}{
+		{
+			name:       "quoted codecs with commas",
+			attributes: `BANDWIDTH=1280000,CODECS="avc1.42e00a,mp4a.40.2",RESOLUTION=640x360`,
+			want:       &hlsVariant{Bandwidth: 1280000, Width: 640, Height: 360, Codecs: "avc1.42e00a,mp4a.40.2"},
+		},
+		{
+			name:       "quoted codecs at the end",
+			attributes: `BANDWIDTH=1280000,CODECS="avc1.42e00a,mp4a.40.2"`,
+			want:       &hlsVariant{Bandwidth: 1280000, Codecs: "avc1.42e00a,mp4a.40.2"},
+		},
+		{
+			name:       "average bandwidth",
+			attributes: "AVERAGE-BANDWIDTH=900000,BANDWIDTH=1000000",
+			want:       &hlsVariant{Bandwidth: 1000000, AverageBandwidth: 900000},
+		},
+		{name: "missing bandwidth", attributes: "RESOLUTION=640x360", wantErr: true},
+		{name: "invalid bandwidth", attributes: "BANDWIDTH=fast", wantErr: true},
+		{name: "invalid resolution", attributes: "BANDWIDTH=1000000,RESOLUTION=640", wantErr: true},
+		{name: "unterminated quoted codecs", attributes: `BANDWIDTH=1000000,CODECS="avc1.42e00a,mp4a.40.2`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHLSVariant(tt.attributes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHLSAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "unquoted values",
+			s:    "BANDWIDTH=1000000,RESOLUTION=640x360",
+			want: map[string]string{"BANDWIDTH": "1000000", "RESOLUTION": "640x360"},
+		},
+		{
+			name: "quoted value containing commas",
+			s:    `CODECS="avc1.42e00a,mp4a.40.2",BANDWIDTH=1000000`,
+			want: map[string]string{"CODECS": "avc1.42e00a,mp4a.40.2", "BANDWIDTH": "1000000"},
+		},
+		{
+			name: "trailing comma",
+			s:    "BANDWIDTH=1000000,",
+			want: map[string]string{"BANDWIDTH": "1000000"},
+		},
+		{name: "missing equals", s: "BANDWIDTH", wantErr: true},
+		{name: "empty name", s: "=1000000", wantErr: true},
+		{name: "garbage after quoted value", s: `CODECS="avc1.42e00a"x,BANDWIDTH=1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHLSAttributes(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func openHLSFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "hls", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
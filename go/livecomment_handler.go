@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -75,28 +74,93 @@ func getLivecommentsHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+	since, err := parseSinceRequest(c)
+	if err != nil {
+		return err
+	}
+	if since != nil && page != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "since_id and since_ts can't be used with cursor")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if _, err := getViewableLivestream(ctx, tx, livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// 差分取得はメモリ上の直近の投稿から返し、新しく投稿された分だけを詰める
+	if since != nil {
+		livecommentModels, ok, err := recentLivecomments.Since(ctx, int64(livestreamID), since)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		if !ok {
+			if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? AND created_at >= ? ORDER BY id", livestreamID, since.ID, since.Timestamp); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+			}
+		}
+		livecommentModels, err = sinceItemsResponse(c, livecommentModels)
+		if err != nil {
+			return err
+		}
+
+		livecomments := make([]Livecomment, len(livecommentModels))
+		for i := range livecommentModels {
+			livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+			}
+			livecomments[i] = livecomment
+		}
+
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, livecomments)
+	}
+
+	query := "SELECT * FROM livecomments WHERE livestream_id = ?"
+	params := []interface{}{livestreamID}
+	if page != nil {
+		pageCondition, pageParams := page.idCondition("id")
+		query += pageCondition + " ORDER BY id DESC LIMIT ?"
+		params = append(params, pageParams...)
+		params = append(params, page.fetchLimit())
+	} else {
+		query += " ORDER BY created_at DESC"
+		limit, ok, err := parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			query += " LIMIT ?"
+			params = append(params, limit)
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, params...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
@@ -104,6 +168,13 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
+	nextCursor := ""
+	if page != nil {
+		var n int
+		n, nextCursor = page.paginateByID(len(livecommentModels), func(i int) int64 { return livecommentModels[i].ID })
+		livecommentModels = livecommentModels[:n]
+	}
+
 	livecomments := make([]Livecomment, len(livecommentModels))
 	for i := range livecommentModels {
 		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
@@ -118,6 +189,9 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[Livecomment]{Items: livecomments, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, livecomments)
 }
 
@@ -138,14 +212,53 @@ func getNgwords(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
+	// モデレーション権限があれば、コラボレーターが登録したものも含めて配信のNGワードを全て返す
+	query := "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ?"
+	args := []interface{}{userID, livestreamID}
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err == nil {
+		canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+		if canModerate {
+			query = "SELECT * FROM ng_words WHERE livestream_id = ?"
+			args = []interface{}{livestreamID}
+		}
+	}
+	if page != nil {
+		pageCondition, pageParams := page.idCondition("id")
+		query += pageCondition + " ORDER BY id DESC LIMIT ?"
+		args = append(args, pageParams...)
+		args = append(args, page.fetchLimit())
+	} else {
+		query += " ORDER BY created_at DESC"
+		limit, ok, err := parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			query += " LIMIT ?"
+			args = append(args, limit)
+		}
+	}
+
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &ngWords, query, args...); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -157,6 +270,10 @@ func getNgwords(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		n, nextCursor := page.paginateByID(len(ngWords), func(i int) int64 { return ngWords[i].ID })
+		return c.JSON(http.StatusOK, Page[*NGWord]{Items: ngWords[:n], NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, ngWords)
 }
 
@@ -183,30 +300,43 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	livecomment, err := createLivecomment(ctx, c.Logger(), userID, livestreamID, req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, livecomment)
+}
+
+// NGワードの判定をしてライブコメントを投稿し、購読者に配信する
+// HTTPとWebSocketの両方から使うので、エラーはecho.NewHTTPErrorで返す
+// 配信に失敗しても投稿は成功しているので、loggerに残すだけにする
+func createLivecomment(ctx context.Context, logger echo.Logger, userID int64, livestreamID int, req *PostLivecommentRequest) (Livecomment, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	livestreamModel, err := getViewableLivestream(ctx, tx, livestreamID, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return Livecomment{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
 
 	// スパム判定
 	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	// コラボレーターが登録したNGワードも対象にするため、配信で絞り込む
+	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE livestream_id = ?", livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
 	for _, ngword := range ngwords {
 		if strings.Contains(req.Comment, ngword.Word) {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+			return Livecomment{}, echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
 	}
 
@@ -221,25 +351,31 @@ func postLivecommentHandler(c echo.Context) error {
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
 	}
 
 	livecommentID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
 	}
 	livecommentModel.ID = livecommentID
 
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livecomment)
+	recentLivecomments.Add(livecommentModel.LivestreamID, livecommentModel)
+	trending.Record(livecommentModel.LivestreamID, livecommentTrendingWeight(livecommentModel.Tip), livecommentModel.CreatedAt)
+	if err := livestreamEvents.Publish(livecommentModel.LivestreamID, livestreamEventLivecomment, livecomment); err != nil {
+		logger.Warnf("failed to publish livecomment event: %v", err)
+	}
+
+	return livecomment, nil
 }
 
 func reportLivecommentHandler(c echo.Context) error {
@@ -270,7 +406,7 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	_, err = getLivestream(ctx, tx, livestreamID)
+	_, err = getViewableLivestream(ctx, tx, livestreamID, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
@@ -346,22 +482,29 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	// var ownedLivestreams []LivestreamModel
-	var ownedLivestreams int
-	if err := tx.GetContext(ctx, &ownedLivestreams, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ? AND user_id = ?) AS has_rows", livestreamID, userID); err != nil {
+	// 配信者自身またはコラボレーターによるmoderateなのかを検証
+	canModerate := false
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if ownedLivestreams == 0 {
+	if err == nil {
+		canModerate, err = canModerateLivestream(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
+	ngWord := NGWord{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
-	})
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &ngWord)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
 	}
@@ -370,8 +513,14 @@ func moderateHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
+	ngWord.ID = wordID
 
 	// NGワードにヒットする過去の投稿も全削除する
+	// 視聴者の画面からも消せるよう、削除するIDを控えておく
+	var deletedIDs []int64
+	if err := tx.SelectContext(ctx, &deletedIDs, "SELECT id FROM livecomments WHERE livestream_id = ? AND comment LIKE ? FOR UPDATE", livestreamID, "%"+req.NGWord+"%"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get old livecomments that hit spams: "+err.Error())
+	}
 	query := `
 	DELETE FROM livecomments
 	WHERE
@@ -386,6 +535,16 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	recentLivecomments.Remove(ngWord.LivestreamID, deletedIDs)
+	if err := livestreamEvents.Publish(ngWord.LivestreamID, livestreamEventNGWord, ngWord); err != nil {
+		c.Logger().Warnf("failed to publish NG word event: %v", err)
+	}
+	if len(deletedIDs) > 0 {
+		if err := livestreamEvents.Publish(ngWord.LivestreamID, livestreamEventLivecommentDeleted, LivecommentsDeletedEvent{LivecommentIDs: deletedIDs}); err != nil {
+			c.Logger().Warnf("failed to publish livecomment deletion event: %v", err)
+		}
+	}
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
 	})
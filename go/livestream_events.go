@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	livestreamEventLivecomment        = "livecomment"
+	livestreamEventReaction           = "reaction"
+	livestreamEventLivecommentDeleted = "livecomment_deleted"
+	livestreamEventNGWord             = "ngword"
+	// 取りこぼしたイベントを再送できないので、一覧を取得し直してもらう
+	livestreamEventReset = "reset"
+)
+
+const (
+	// 再接続時に再送できるよう、配信ごとに直近のイベントを保持する数
+	livestreamEventBufferSize = 256
+	// 購読者ごとの未送信イベントの上限。溢れた購読者は切断する
+	livestreamEventSubscriberBufferSize = 64
+)
+
+type LivestreamEvent struct {
+	// 配信ごとに1から振られる連番
+	ID   int64
+	Type string
+	Data json.RawMessage
+}
+
+type LivecommentsDeletedEvent struct {
+	LivecommentIDs []int64 `json:"livecomment_ids"`
+}
+
+type livestreamEventStream struct {
+	lastID int64
+	// lastIDまでの直近のイベントを古い順に保持するリングバッファ
+	buffer      [livestreamEventBufferSize]LivestreamEvent
+	subscribers map[chan LivestreamEvent]struct{}
+}
+
+// 配信ごとのイベントを購読者に配信する
+// イベントはこのホストの中でのみ配信され、IDもホストごとに振られる
+type livestreamEventHub struct {
+	mu          sync.Mutex
+	livestreams map[int64]*livestreamEventStream
+}
+
+func newLivestreamEventHub() *livestreamEventHub {
+	return &livestreamEventHub{
+		livestreams: map[int64]*livestreamEventStream{},
+	}
+}
+
+// 購読者は全て切断される
+func (h *livestreamEventHub) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.livestreams {
+		for ch := range s.subscribers {
+			close(ch)
+		}
+	}
+	h.livestreams = map[int64]*livestreamEventStream{}
+}
+
+func (h *livestreamEventHub) Publish(livestreamID int64, eventType string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stream(livestreamID)
+	s.lastID++
+	event := LivestreamEvent{ID: s.lastID, Type: eventType, Data: b}
+	s.buffer[s.lastID%livestreamEventBufferSize] = event
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 追いつけない購読者は切断し、Last-Event-IDで再接続してもらう
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// lastEventIDより後のイベントと、以降のイベントを受け取るチャネルを返す
+// lastEventIDが負の場合は、これから発生するイベントだけを受け取る
+// 再送できないイベントがあった場合は、resetイベントから始める
+func (h *livestreamEventHub) Subscribe(livestreamID, lastEventID int64) ([]LivestreamEvent, chan LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stream(livestreamID)
+
+	var backlog []LivestreamEvent
+	if lastEventID < 0 {
+		lastEventID = s.lastID
+	}
+	if lastEventID > s.lastID || lastEventID < s.lastID-livestreamEventBufferSize {
+		// 再起動などでIDが振り直されたか、バッファから溢れている
+		backlog = append(backlog, LivestreamEvent{ID: s.lastID, Type: livestreamEventReset, Data: json.RawMessage("{}")})
+	} else {
+		for id := lastEventID + 1; id <= s.lastID; id++ {
+			backlog = append(backlog, s.buffer[id%livestreamEventBufferSize])
+		}
+	}
+
+	ch := make(chan LivestreamEvent, livestreamEventSubscriberBufferSize)
+	s.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+func (h *livestreamEventHub) Unsubscribe(livestreamID int64, ch chan LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.livestreams[livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *livestreamEventHub) stream(livestreamID int64) *livestreamEventStream {
+	s, ok := h.livestreams[livestreamID]
+	if !ok {
+		s = &livestreamEventStream{subscribers: map[chan LivestreamEvent]struct{}{}}
+		h.livestreams[livestreamID] = s
+	}
+	return s
+}
@@ -24,6 +24,24 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// コラボレーターとして招待するユーザのID
+	Collaborators []int64 `json:"collaborators"`
+	// public (default), unlisted, private
+	Visibility string `json:"visibility"`
+	// privateの場合に閲覧を許可するユーザのID
+	Invitees []int64 `json:"invitees"`
+}
+
+type UpdateLivestreamRequest struct {
+	Tags         *[]int64 `json:"tags"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	StartAt      *int64   `json:"start_at"`
+	EndAt        *int64   `json:"end_at"`
+	Visibility   *string  `json:"visibility"`
+	Invitees     *[]int64 `json:"invitees"`
 }
 
 type LivestreamViewerModel struct {
@@ -41,18 +59,28 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	CanceledAt   int64  `db:"canceled_at" json:"canceled_at"`
+	SeriesID     int64  `db:"series_id" json:"series_id"`
+	Visibility   string `db:"visibility" json:"visibility"`
 }
 
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID            int64  `json:"id"`
+	Owner         User   `json:"owner"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	PlaylistUrl   string `json:"playlist_url"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	Tags          []Tag  `json:"tags"`
+	Collaborators []User `json:"collaborators"`
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	// upcoming, live, ended, canceled
+	Status     string `json:"status"`
+	SeriesID   int64  `json:"series_id,omitempty"`
+	Visibility string `json:"visibility"`
+	// プレイリストを検査した場合のみ、画質ごとの情報が入る
+	Variants []PlaylistVariant `json:"variants"`
 }
 
 type LivestreamTagModel struct {
@@ -86,6 +114,18 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if err := validateLivestreamMediaURLs(req.PlaylistUrl, req.ThumbnailUrl); err != nil {
+		return err
+	}
+	visibility, err := normalizeLivestreamVisibility(req.Visibility)
+	if err != nil {
+		return err
+	}
+	// プレイリストの取得に時間がかかるので、トランザクションの外で行う
+	variants, err := inspectPlaylist(ctx, req.PlaylistUrl)
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -94,34 +134,18 @@ func reserveLivestreamHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
+	if !isValidReservationTerm(req.StartAt, req.EndAt) {
 		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
 	}
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	if err := claimReservationSlots(ctx, tx, req.StartAt, req.EndAt); err != nil {
+		if errors.Is(err, errReservationSlotUnavailable) {
+			return echo.NewHTTPError(http.StatusBadRequest, reservationUnavailableMessage(req.StartAt, req.EndAt))
+		}
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
-	for _, slot := range slots {
-		var count int
-		// Todo: cache
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
-	}
 
 	var (
 		livestreamModel = &LivestreamModel{
@@ -132,52 +156,32 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
+			Visibility:   visibility,
 		}
 	)
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
-
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
-	if err != nil {
+	if err := insertLivestream(ctx, tx, livestreamModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
 
-	livestreamID, err := rs.LastInsertId()
+	// タグ追加
+	tags, err := insertLivestreamTags(ctx, tx, livestreamModel.ID, req.Tags)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 	}
-	livestreamModel.ID = livestreamID
 
-	// タグ追加
-	if len(req.Tags) != 0 {
-		tags := make([]Tag, len(req.Tags))
-		query := `INSERT INTO livestream_tags (livestream_id, tag_id) VALUES `
-		for i, tagID := range req.Tags {
-			if i != 0 {
-				query += `, `
-			}
-			query += fmt.Sprintf("(%d, %d)", livestreamID, tagID)
-			tag, err := getTagById(ctx, tx, tagID)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
-			}
-			tags[i] = Tag{
-				ID:   tag.ID,
-				Name: tag.Name,
-			}
-		}
-
-		_, err := tx.ExecContext(ctx, query)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	if variants != nil {
+		if err := replaceLivestreamVariants(ctx, tx, livestreamModel.ID, variants); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream variants: "+err.Error())
 		}
+	}
 
-		if _, err := tx.ExecContext(ctx, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
-		}
-		livestreamTagsCache.Store(livestreamID, tags)
+	// コラボレーターの招待
+	if err := inviteLivestreamCollaborators(ctx, tx, livestreamModel, req.Collaborators); err != nil {
+		return err
+	}
+	if err := replaceLivestreamInvitees(ctx, tx, livestreamModel, req.Invitees); err != nil {
+		return err
 	}
 
 	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
@@ -189,12 +193,38 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	pendingLivestreamTags{livestreamModel.ID: tags}.apply()
+
 	return c.JSON(http.StatusCreated, livestream)
 }
 
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+	keyword := c.QueryParam("q")
+	status := c.QueryParam("status")
+	if status != "" && !isValidLivestreamStatus(status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be live, upcoming or ended")
+	}
+	tagFilter, err := parseTagSearchFilter(c)
+	if err != nil {
+		return err
+	}
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+	// 0の場合は全件
+	limit := 0
+	if page != nil {
+		limit = page.fetchLimit()
+	} else {
+		limit, _, err = parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	viewerID := getSessionUserID(c)
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -202,45 +232,47 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if keyTagName != "" {
-		// タグによる取得
+	// タグによる絞り込み
+	var includeIDs, excludeIDs []int64
+	if tagFilter != nil {
+		includeIDs, excludeIDs, err = tagFilter.resolve(ctx, tx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to resolve tags: "+err.Error())
+		}
+	}
 
-		cachedLivestreamModels, ok := livestreamByKeyTagNameCache.Load(keyTagName)
-		if ok {
-			livestreamModels = cachedLivestreamModels.([]*LivestreamModel)
-		} else {
-			query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (SELECT id FROM tags WHERE name = ?)) ORDER BY id DESC", keyTagName)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get or set cache: "+err.Error())
+	livestreamModels := []*LivestreamModel{}
+	if includeIDs == nil || len(includeIDs) != 0 {
+		condition, params := buildLivestreamSearchCondition(status, now, viewerID, includeIDs, excludeIDs)
+		if keyword != "" {
+			// キーワードによる検索
+			offset := 0
+			if page != nil {
+				offset = page.Cursor.Offset
 			}
-
-			if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get or set cache: "+err.Error())
+			livestreamModels, err = searchLivestreamsByKeyword(ctx, tx, keyword, condition, params, limit, offset)
+		} else {
+			if page != nil {
+				pageCondition, pageParams := page.idCondition("l.id")
+				condition += pageCondition
+				params = append(params, pageParams...)
 			}
-
-			livestreamByKeyTagNameCache.Store(keyTagName, livestreamModels)
-
-			go func() {
-				// キャッシュの有効期限を設定
-				time.Sleep(10 * time.Minute)
-				livestreamByKeyTagNameCache.Delete(keyTagName)
-			}()
+			livestreamModels, err = searchLivestreams(ctx, tx, condition, params, limit)
 		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	nextCursor := ""
+	if page != nil {
+		var n int
+		if keyword != "" {
+			n, nextCursor = page.paginateByOffset(len(livestreamModels))
+		} else {
+			n, nextCursor = page.paginateByID(len(livestreamModels), func(i int) int64 { return livestreamModels[i].ID })
 		}
+		livestreamModels = livestreamModels[:n]
 	}
 
 	livestreams := make([]Livestream, len(livestreamModels))
@@ -256,6 +288,9 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, livestreams)
 }
 
@@ -265,6 +300,11 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -276,10 +316,36 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	query := "SELECT * FROM livestreams WHERE user_id = ? AND canceled_at = 0"
+	params := []interface{}{userID}
+	if page != nil {
+		pageCondition, pageParams := page.idCondition("id")
+		query += pageCondition + " ORDER BY id DESC LIMIT ?"
+		params = append(params, pageParams...)
+		params = append(params, page.fetchLimit())
+	} else {
+		query += " ORDER BY id DESC"
+		limit, ok, err := parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			query += " LIMIT ?"
+			params = append(params, limit)
+		}
+	}
+
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+
+	nextCursor := ""
+	if page != nil {
+		var n int
+		n, nextCursor = page.paginateByID(len(livestreamModels), func(i int) int64 { return livestreamModels[i].ID })
+		livestreamModels = livestreamModels[:n]
+	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
@@ -293,6 +359,9 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, livestreams)
 }
 
@@ -304,6 +373,11 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -318,10 +392,42 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	viewerID := sess.Values[defaultUserIDKey].(int64)
+
+	visibilityCondition, visibilityParams := listableLivestreamCondition("livestreams", viewerID)
+	query := "SELECT * FROM livestreams WHERE user_id = ? AND canceled_at = 0 AND " + visibilityCondition
+	params := append([]interface{}{user.ID}, visibilityParams...)
+	if page != nil {
+		pageCondition, pageParams := page.idCondition("id")
+		query += pageCondition + " ORDER BY id DESC LIMIT ?"
+		params = append(params, pageParams...)
+		params = append(params, page.fetchLimit())
+	} else {
+		query += " ORDER BY id DESC"
+		limit, ok, err := parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			query += " LIMIT ?"
+			params = append(params, limit)
+		}
+	}
+
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+
+	nextCursor := ""
+	if page != nil {
+		var n int
+		n, nextCursor = page.paginateByID(len(livestreamModels), func(i int) int64 { return livestreamModels[i].ID })
+		livestreamModels = livestreamModels[:n]
+	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
@@ -335,9 +441,324 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[Livestream]{Items: livestreams, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, livestreams)
 }
 
+// 配信予約のキャンセルAPI
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 並列なキャンセルで枠を二重に戻さないようにロックを取る
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't cancel other streamer's livestream")
+	}
+	if livestreamModel.CanceledAt != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the livestream has already been canceled")
+	}
+
+	now := time.Now().Unix()
+	if now >= livestreamModel.StartAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel the livestream that has already started")
+	}
+
+	pendingTags := pendingLivestreamTags{}
+	if err := cancelLivestream(ctx, tx, &livestreamModel, now, pendingTags); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	evictLivestreamCache(livestreamModel.ID)
+	livestreamTagIndex.Remove(livestreamModel.ID)
+	pendingTags.apply()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信をキャンセル済みにし、確保していた枠を返却する
+// 繰り上がった配信のタグはpendingTagsに積む
+func cancelLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64, pendingTags pendingLivestreamTags) error {
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET canceled_at = ? WHERE id = ?", now, livestreamModel.ID); err != nil {
+		return err
+	}
+	livestreamModel.CanceledAt = now
+	// 空いた枠でキャンセル待ちを繰り上げる
+	if _, err := promoteReservationWaitlist(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt, pendingTags); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 配信の編集・リスケジュールAPI
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	// 他の配信者の配信でプレイリストを取得させないよう、所有者を確かめてから検査する
+	// 検査中は行ロックを取らないので、トランザクションの中でもう一度確かめる
+	ownedLivestreamModel, err := getLivestream(ctx, dbConn, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownedLivestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livestream")
+	}
+	variants, err := inspectLivestreamUpdate(ctx, req, ownedLivestreamModel.ID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livestream")
+	}
+	if livestreamModel.CanceledAt != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update the canceled livestream")
+	}
+
+	pendingTags := pendingLivestreamTags{}
+	if err := applyLivestreamUpdate(ctx, tx, &livestreamModel, req, variants, pendingTags); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	evictLivestreamCache(livestreamModel.ID)
+	pendingTags.apply()
+
+	livestreams, err := fillCommittedLivestreamResponses(ctx, []*LivestreamModel{&livestreamModel})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams[0])
+}
+
+// リクエストの内容をlivestreamModelに反映し、DBを更新する
+// 開始時刻・終了時刻が変わる場合は、元の枠を返却して新しい枠を確保する
+// variantsはinspectLivestreamUpdateで検査したプレイリストの画質ごとの情報
+// 付け替えたタグと、繰り上がった配信のタグはpendingTagsに積む
+func applyLivestreamUpdate(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, req *UpdateLivestreamRequest, variants []PlaylistVariant, pendingTags pendingLivestreamTags) error {
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+		if err := replaceLivestreamVariants(ctx, tx, livestreamModel.ID, variants); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream variants: "+err.Error())
+		}
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if req.Visibility != nil {
+		visibility, err := normalizeLivestreamVisibility(*req.Visibility)
+		if err != nil {
+			return err
+		}
+		livestreamModel.Visibility = visibility
+	}
+	if req.Invitees != nil {
+		if err := replaceLivestreamInvitees(ctx, tx, livestreamModel, *req.Invitees); err != nil {
+			return err
+		}
+	}
+
+	startAt, endAt := livestreamModel.StartAt, livestreamModel.EndAt
+	if req.StartAt != nil {
+		startAt = *req.StartAt
+	}
+	if req.EndAt != nil {
+		endAt = *req.EndAt
+	}
+	if startAt != livestreamModel.StartAt || endAt != livestreamModel.EndAt {
+		if time.Now().Unix() >= livestreamModel.StartAt {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't reschedule the livestream that has already started")
+		}
+		if startAt >= endAt || !isValidReservationTerm(startAt, endAt) {
+			return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+		}
+
+		if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+		}
+		if err := claimReservationSlots(ctx, tx, startAt, endAt); err != nil {
+			if errors.Is(err, errReservationSlotUnavailable) {
+				return echo.NewHTTPError(http.StatusBadRequest, reservationUnavailableMessage(startAt, endAt))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		}
+		// 元の区間で空いた枠でキャンセル待ちを繰り上げる
+		if _, err := promoteReservationWaitlist(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt, pendingTags); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to promote reservation waitlist: "+err.Error())
+		}
+		livestreamModel.StartAt = startAt
+		livestreamModel.EndAt = endAt
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, start_at = :start_at, end_at = :end_at, visibility = :visibility WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	if req.Tags != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tag: "+err.Error())
+		}
+		tags, err := insertLivestreamTags(ctx, tx, livestreamModel.ID, *req.Tags)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+		}
+		pendingTags[livestreamModel.ID] = tags
+	}
+
+	return nil
+}
+
+func insertLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel) error {
+	if livestreamModel.Visibility == "" {
+		livestreamModel.Visibility = livestreamVisibilityPublic
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, series_id, visibility) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :series_id, :visibility)", livestreamModel)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return err
+	}
+	livestreamModel.ID = livestreamID
+
+	return nil
+}
+
+// livestream_tagsにタグを追加し、追加したタグを返す
+// キャッシュはコミットした後にpendingLivestreamTagsで更新する
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) ([]Tag, error) {
+	if len(tagIDs) == 0 {
+		return []Tag{}, nil
+	}
+
+	tags := make([]Tag, len(tagIDs))
+	query := `INSERT INTO livestream_tags (livestream_id, tag_id) VALUES `
+	for i, tagID := range tagIDs {
+		if i != 0 {
+			query += `, `
+		}
+		query += fmt.Sprintf("(%d, %d)", livestreamID, tagID)
+		tag, err := getTagById(ctx, tx, tagID)
+		if err != nil {
+			return nil, err
+		}
+		tags[i] = Tag{
+			ID:   tag.ID,
+			Name: tag.Name,
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// トランザクション中に付け替えた配信ごとのタグ
+// ロールバックされたものをキャッシュに残さないよう、コミットした後にapplyで反映する
+type pendingLivestreamTags map[int64][]Tag
+
+func (p pendingLivestreamTags) apply() {
+	for livestreamID, tags := range p {
+		livestreamTagsCache.Store(livestreamID, tags)
+		if len(tags) == 0 {
+			livestreamTagIndex.Remove(livestreamID)
+			continue
+		}
+		tagIDs := make([]int64, len(tags))
+		for i, tag := range tags {
+			tagIDs[i] = tag.ID
+		}
+		livestreamTagIndex.Set(livestreamID, tagIDs)
+	}
+}
+
 // viewerテーブルの廃止
 func enterLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
@@ -362,20 +783,39 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	livestreamModel, err := getViewableLivestream(ctx, tx, livestreamID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    now,
 	}
 
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	if err := insertWatchLog(ctx, tx, userID, livestreamModel.ID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert watch log: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// 配信中なら、入室を最初のハートビートとして扱う
+	if livestreamStatus(*livestreamModel, now) == livestreamStatusLive {
+		if _, err := presence.Heartbeat(ctx, dbConn, livestreamModel.ID, userID, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record heartbeat: "+err.Error())
+		}
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -405,11 +845,16 @@ func exitLivestreamHandler(c echo.Context) error {
 	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
+	if err := closeWatchLogs(ctx, tx, userID, int64(livestreamID), time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update watch log: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	presence.Leave(int64(livestreamID), userID)
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -420,6 +865,11 @@ func getLivestreamHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -431,7 +881,8 @@ func getLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	// 閲覧できない非公開の配信は、存在しないものとして扱う
+	livestreamModel, err := getViewableLivestream(ctx, tx, livestreamID, userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 	}
@@ -463,6 +914,11 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -479,15 +935,45 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	// existence already check
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	if livestreamModel.UserID != userID {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
+	query := "SELECT * FROM livecomment_reports WHERE livestream_id = ?"
+	params := []interface{}{livestreamID}
+	if page != nil {
+		pageCondition, pageParams := page.idCondition("id")
+		query += pageCondition + " ORDER BY id DESC LIMIT ?"
+		params = append(params, pageParams...)
+		params = append(params, page.fetchLimit())
+	} else {
+		query += " ORDER BY id DESC"
+		limit, ok, err := parseLegacyLimit(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			query += " LIMIT ?"
+			params = append(params, limit)
+		}
+	}
+
 	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reportModels, query, params...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
+	nextCursor := ""
+	if page != nil {
+		var n int
+		n, nextCursor = page.paginateByID(len(reportModels), func(i int) int64 { return reportModels[i].ID })
+		reportModels = reportModels[:n]
+	}
+
 	reports := make([]LivecommentReport, len(reportModels))
 	for i := range reportModels {
 		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
@@ -501,9 +987,36 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[LivecommentReport]{Items: reports, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, reports)
 }
 
+// 更新をコミットしてキャッシュを破棄した後に、コミットした内容でレスポンスを組み立てる
+// トランザクションの中で組み立てると、タグやプレイリストの画質が書き換える前のキャッシュから返ってしまう
+func fillCommittedLivestreamResponses(ctx context.Context, livestreamModels []*LivestreamModel) ([]Livestream, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return nil, err
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return livestreams, nil
+}
+
 // q: この関数は何をしている? 詳細に教えてください
 // a: ライブストリームの情報を取得しています。livestreamsテーブルからlivestream_idをもとにlivestreamModelを取得し、
 //
@@ -523,22 +1036,48 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 	if cachedTags, ok := livestreamTagsCache.Load(livestreamModel.ID); ok {
 		tags = cachedTags.([]Tag)
 	} else {
-		if err := tx.SelectContext(ctx, &tags, "SELECT * FROM tags WHERE id IN (SELECT tag_id FROM livestream_tags WHERE livestream_id = ?)", livestreamModel.ID); err != nil {
+		if err := tx.SelectContext(ctx, &tags, "SELECT id, name FROM tags WHERE id IN (SELECT tag_id FROM livestream_tags WHERE livestream_id = ?)", livestreamModel.ID); err != nil {
 			return Livestream{}, err
 		}
 		livestreamTagsCache.Store(livestreamModel.ID, tags)
 	}
 
+	collaboratorIDs, err := getAcceptedCollaboratorIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return Livestream{}, err
+	}
+	collaborators := make([]User, len(collaboratorIDs))
+	for i, collaboratorID := range collaboratorIDs {
+		collaboratorModel, err := getUserById(ctx, tx, collaboratorID)
+		if err != nil {
+			return Livestream{}, err
+		}
+		collaborators[i], err = fillUserResponse(ctx, tx, *collaboratorModel)
+		if err != nil {
+			return Livestream{}, err
+		}
+	}
+
+	variants, err := getLivestreamVariants(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return Livestream{}, err
+	}
+
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:            livestreamModel.ID,
+		Owner:         owner,
+		Title:         livestreamModel.Title,
+		Tags:          tags,
+		Collaborators: collaborators,
+		Description:   livestreamModel.Description,
+		PlaylistUrl:   livestreamModel.PlaylistUrl,
+		ThumbnailUrl:  livestreamModel.ThumbnailUrl,
+		StartAt:       livestreamModel.StartAt,
+		EndAt:         livestreamModel.EndAt,
+		Status:        livestreamStatus(livestreamModel, time.Now().Unix()),
+		SeriesID:      livestreamModel.SeriesID,
+		Visibility:    livestreamModel.Visibility,
+		Variants:      variants,
 	}
 	return livestream, nil
 }
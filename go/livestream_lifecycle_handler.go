@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamStatusUpcoming = "upcoming"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+	livestreamStatusCanceled = "canceled"
+
+	livestreamActionStart  = "start"
+	livestreamActionExtend = "extend"
+	livestreamActionEnd    = "end"
+)
+
+// 各操作が可能な配信の状態
+var livestreamTransitions = map[string][]string{
+	livestreamActionStart:  {livestreamStatusUpcoming},
+	livestreamActionExtend: {livestreamStatusUpcoming, livestreamStatusLive},
+	livestreamActionEnd:    {livestreamStatusLive},
+}
+
+type ExtendLivestreamRequest struct {
+	EndAt int64 `json:"end_at"`
+}
+
+func livestreamStatus(livestreamModel LivestreamModel, now int64) string {
+	switch {
+	case livestreamModel.CanceledAt != 0:
+		return livestreamStatusCanceled
+	case now < livestreamModel.StartAt:
+		return livestreamStatusUpcoming
+	case now < livestreamModel.EndAt:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusEnded
+	}
+}
+
+func isValidLivestreamStatus(status string) bool {
+	switch status {
+	case livestreamStatusUpcoming, livestreamStatusLive, livestreamStatusEnded:
+		return true
+	}
+	return false
+}
+
+// 状態で絞り込むためのWHERE句の条件
+func livestreamStatusCondition(status string, now int64) (string, []interface{}) {
+	switch status {
+	case livestreamStatusUpcoming:
+		return "start_at > ?", []interface{}{now}
+	case livestreamStatusLive:
+		return "start_at <= ? AND end_at > ?", []interface{}{now, now}
+	case livestreamStatusEnded:
+		return "end_at <= ?", []interface{}{now}
+	}
+	return "1 = 1", nil
+}
+
+// 配信の前倒し開始API
+// POST /api/livestream/:livestream_id/start
+func startLivestreamHandler(c echo.Context) error {
+	return transitLivestream(c, livestreamActionStart, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64, pendingTags pendingLivestreamTags) error {
+		// 前倒しした分の枠を、今の時刻を含む枠から確保する
+		if err := claimReservationSlots(ctx, tx, reservationSlotStartAt(now), livestreamModel.StartAt); err != nil {
+			return err
+		}
+		livestreamModel.StartAt = now
+		return nil
+	})
+}
+
+// 配信の延長API
+// POST /api/livestream/:livestream_id/extend
+func extendLivestreamHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	var req *ExtendLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	return transitLivestream(c, livestreamActionExtend, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64, pendingTags pendingLivestreamTags) error {
+		if req.EndAt <= livestreamModel.EndAt {
+			return echo.NewHTTPError(http.StatusBadRequest, "end_at must be later than the current end_at")
+		}
+		if !isValidReservationTerm(livestreamModel.EndAt, req.EndAt) {
+			return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+		}
+		// 延長した分の枠を確保する
+		if err := claimReservationSlots(ctx, tx, livestreamModel.EndAt, req.EndAt); err != nil {
+			return err
+		}
+		livestreamModel.EndAt = req.EndAt
+		return nil
+	})
+}
+
+// 配信の早期終了API
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return transitLivestream(c, livestreamActionEnd, func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64, pendingTags pendingLivestreamTags) error {
+		// 使わなくなった枠を、今の時刻を含む枠から返却する
+		slotStartAt := reservationSlotStartAt(now)
+		if err := releaseReservationSlots(ctx, tx, slotStartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		if _, err := promoteReservationWaitlist(ctx, tx, slotStartAt, livestreamModel.EndAt, pendingTags); err != nil {
+			return err
+		}
+		livestreamModel.EndAt = now
+		return nil
+	})
+}
+
+// 配信者が配信の状態を遷移させる
+// applyはlivestreamModelの開始・終了時刻を書き換え、必要な枠の確保・返却を行う
+// 繰り上がった配信のタグはpendingTagsに積み、コミットした後にキャッシュへ反映する
+func transitLivestream(c echo.Context, action string, apply func(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, now int64, pendingTags pendingLivestreamTags) error) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's livestream")
+	}
+
+	now := time.Now().Unix()
+	status := livestreamStatus(livestreamModel, now)
+	allowed := false
+	for _, from := range livestreamTransitions[action] {
+		if status == from {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("can't %s the livestream in %s status", action, status))
+	}
+
+	pendingTags := pendingLivestreamTags{}
+	if err := apply(ctx, tx, &livestreamModel, now, pendingTags); err != nil {
+		if errors.Is(err, errReservationSlotUnavailable) {
+			return echo.NewHTTPError(http.StatusBadRequest, "reservation slots are not available for the requested time")
+		}
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return he
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET start_at = ?, end_at = ? WHERE id = ?", livestreamModel.StartAt, livestreamModel.EndAt, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	evictLivestreamCache(livestreamModel.ID)
+	pendingTags.apply()
+
+	livestreams, err := fillCommittedLivestreamResponses(ctx, []*LivestreamModel{&livestreamModel})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams[0])
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// キーワード検索でのタイトルの重み
+const keywordSearchTitleWeight = 2
+
+type scoredLivestreamModel struct {
+	LivestreamModel
+	Score float64 `db:"score"`
+}
+
+// タグによる絞り込み条件
+// ?tag=a (後方互換) または ?tags=a,b&mode=and|or と ?exclude_tags=c,d
+type tagSearchFilter struct {
+	Tags        []string
+	Mode        string
+	ExcludeTags []string
+}
+
+func parseTagSearchFilter(c echo.Context) (*tagSearchFilter, error) {
+	filter := &tagSearchFilter{
+		Tags:        splitTagNames(c.QueryParam("tags")),
+		Mode:        c.QueryParam("mode"),
+		ExcludeTags: splitTagNames(c.QueryParam("exclude_tags")),
+	}
+	if keyTagName := c.QueryParam("tag"); keyTagName != "" {
+		filter.Tags = append(filter.Tags, keyTagName)
+	}
+	if len(filter.Tags) == 0 && len(filter.ExcludeTags) == 0 {
+		return nil, nil
+	}
+
+	if filter.Mode == "" {
+		filter.Mode = tagSearchModeOr
+	}
+	if filter.Mode != tagSearchModeAnd && filter.Mode != tagSearchModeOr {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "mode query parameter must be and or or")
+	}
+	return filter, nil
+}
+
+func splitTagNames(s string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// タグ名 (別名も可) を、子孫のタグを含めたタグIDのグループに変換する。存在しないタグ名はmissingとして返す
+func resolveTagGroups(ctx context.Context, tx db, names []string) (tagGroups [][]int64, missing int, err error) {
+	for _, name := range names {
+		tag, err := getTagByNameOrAlias(ctx, tx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			missing++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		tagGroups = append(tagGroups, tagDescendantIDs(tag.ID))
+	}
+	return tagGroups, missing, nil
+}
+
+// 絞り込み条件をタグのインデックスで配信IDに変換する
+// includeIDsがnilの場合は含めるタグで絞り込まない
+func (f *tagSearchFilter) resolve(ctx context.Context, tx db) (includeIDs []int64, excludeIDs []int64, err error) {
+	if len(f.Tags) != 0 {
+		tagGroups, missing, err := resolveTagGroups(ctx, tx, f.Tags)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.Mode == tagSearchModeAnd && missing > 0 {
+			// 存在しないタグを全て含む配信はない
+			return []int64{}, nil, nil
+		}
+		includeIDs = livestreamTagIndex.Search(tagGroups, f.Mode)
+	}
+	if len(f.ExcludeTags) != 0 {
+		tagGroups, _, err := resolveTagGroups(ctx, tx, f.ExcludeTags)
+		if err != nil {
+			return nil, nil, err
+		}
+		excludeIDs = livestreamTagIndex.Search(tagGroups, tagSearchModeOr)
+	}
+	return includeIDs, excludeIDs, nil
+}
+
+// 検索条件からWHERE句を組み立てる
+// 閲覧者が一覧で見られない配信は除く
+func buildLivestreamSearchCondition(status string, now int64, viewerID int64, includeIDs, excludeIDs []int64) (string, []interface{}) {
+	statusCondition, params := livestreamStatusCondition(status, now)
+	visibilityCondition, visibilityParams := listableLivestreamCondition("l", viewerID)
+	condition := "l.canceled_at = 0 AND " + statusCondition + " AND " + visibilityCondition
+	params = append(params, visibilityParams...)
+	if includeIDs != nil {
+		condition += " AND l.id IN (?)"
+		params = append(params, includeIDs)
+	}
+	if len(excludeIDs) != 0 {
+		condition += " AND l.id NOT IN (?)"
+		params = append(params, excludeIDs)
+	}
+	return condition, params
+}
+
+// 条件に一致する配信をIDの降順で返す
+func searchLivestreams(ctx context.Context, tx *sqlx.Tx, condition string, conditionParams []interface{}, limit int) ([]*LivestreamModel, error) {
+	query := `SELECT l.* FROM livestreams l WHERE ` + condition + ` ORDER BY l.id DESC`
+	params := append([]interface{}{}, conditionParams...)
+	if limit > 0 {
+		query += ` LIMIT ?`
+		params = append(params, limit)
+	}
+
+	query, params, err := sqlx.In(query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return nil, err
+	}
+	return livestreamModels, nil
+}
+
+// タイトル・説明文・配信者の表示名をキーワードで全文検索し、関連度の高い順に返す
+// 日本語に対応するため、FULLTEXTインデックスはngramパーサで作成している
+func searchLivestreamsByKeyword(ctx context.Context, tx *sqlx.Tx, keyword string, condition string, conditionParams []interface{}, limit, offset int) ([]*LivestreamModel, error) {
+	query := `
+	SELECT l.*,
+		MATCH(l.title) AGAINST(? IN NATURAL LANGUAGE MODE) * ? +
+		MATCH(l.description) AGAINST(? IN NATURAL LANGUAGE MODE) +
+		MATCH(u.display_name) AGAINST(? IN NATURAL LANGUAGE MODE) AS score
+	FROM livestreams l
+	INNER JOIN users u ON u.id = l.user_id
+	WHERE (
+		MATCH(l.title) AGAINST(? IN NATURAL LANGUAGE MODE) OR
+		MATCH(l.description) AGAINST(? IN NATURAL LANGUAGE MODE) OR
+		MATCH(u.display_name) AGAINST(? IN NATURAL LANGUAGE MODE)
+	) AND ` + condition + ` ORDER BY score DESC, l.id DESC`
+	params := []interface{}{keyword, keywordSearchTitleWeight, keyword, keyword, keyword, keyword, keyword}
+	params = append(params, conditionParams...)
+	if limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		params = append(params, limit, offset)
+	}
+
+	query, params, err := sqlx.In(query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var scored []*scoredLivestreamModel
+	if err := tx.SelectContext(ctx, &scored, query, params...); err != nil {
+		return nil, err
+	}
+
+	livestreamModels := make([]*LivestreamModel, len(scored))
+	for i := range scored {
+		livestreamModels[i] = &scored[i].LivestreamModel
+	}
+	return livestreamModels, nil
+}
@@ -12,7 +12,9 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/goccy/go-json"
@@ -29,24 +31,62 @@ import (
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	adminUsernamesEnvKey           = "ISUCON13_ADMIN_USERNAMES"
+	waitlistDeadlineEnvKey         = "ISUCON13_WAITLIST_DEADLINE_SECONDS"
+	mediaURLAllowedSchemesEnvKey   = "ISUCON13_MEDIA_URL_ALLOWED_SCHEMES"
+	mediaURLAllowedHostsEnvKey     = "ISUCON13_MEDIA_URL_ALLOWED_HOSTS"
+	inspectPlaylistEnvKey          = "ISUCON13_INSPECT_PLAYLIST"
+	ingestSecretEnvKey             = "ISUCON13_INGEST_SECRET"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
-
-	cacheLock                   = sync.Mutex{}
-	livestreamTagsCache         sync.Map
-	usersCache                  sync.Map
-	usersByNameCache            sync.Map
-	themeModelCache             sync.Map
-	iconHashCache               sync.Map
-	imageCache                  sync.Map
-	tagsCache                   sync.Map
-	livestreamCache             sync.Map
-	livestreamByKeyTagNameCache sync.Map
-	reactionsCache              sync.Map
+	// 管理APIを利用できるユーザ名
+	adminUsernames = map[string]bool{}
+	// キャンセル待ちを締め切る、配信開始時刻の何秒前か
+	waitlistDeadline int64 = 60 * 60
+	// プレイリスト・サムネイルのURLに許可するスキームとホスト (ホストが空なら全て許可)
+	mediaURLAllowedSchemes = map[string]bool{"https": true}
+	mediaURLAllowedHosts   []string
+	// 予約時にプレイリストを取得して検査するか
+	inspectPlaylistEnabled = false
+	// メディアサーバが内部APIを呼ぶときの共有シークレット (空なら内部APIは使えない)
+	ingestSecret = ""
+
+	cacheLock           = sync.Mutex{}
+	livestreamTagsCache sync.Map
+	usersCache          sync.Map
+	usersByNameCache    sync.Map
+	themeModelCache     sync.Map
+	iconHashCache       sync.Map
+	imageCache          sync.Map
+	tagsCache           sync.Map
+	tagsByNameCache     sync.Map
+	// 別名→TagAliasModel
+	tagAliasesCache    sync.Map
+	livestreamCache    sync.Map
+	reactionsCache     sync.Map
+	livestreamTagIndex = newTagIndex()
+	trending           = newTrendingCounter()
+	presence           = newPresenceTracker()
+	livestreamEvents   = newLivestreamEventHub()
+	// 差分取得用の直近のライブコメント・リアクション
+	recentLivecomments = newRecentItemBuffer(loadRecentLivecomments,
+		func(m LivecommentModel) int64 { return m.ID },
+		func(m LivecommentModel) int64 { return m.CreatedAt })
+	recentReactions = newRecentItemBuffer(loadRecentReactions,
+		func(m ReactionModel) int64 { return m.ID },
+		func(m ReactionModel) int64 { return m.CreatedAt })
+	// 招待を承諾したコラボレーターのユーザID
+	livestreamCollaboratorsCache sync.Map
+	// 配信の画質ごとの情報
+	livestreamVariantsCache sync.Map
+	// アップロードされたサムネイル画像
+	thumbnailCache sync.Map
+	// 非公開の配信に招待されたユーザID
+	livestreamInviteesCache sync.Map
 )
 
 func init() {
@@ -54,6 +94,49 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv(adminUsernamesEnvKey); ok {
+		for _, name := range splitCommaSeparated(v) {
+			adminUsernames[name] = true
+		}
+	}
+	if v, ok := os.LookupEnv(mediaURLAllowedSchemesEnvKey); ok {
+		mediaURLAllowedSchemes = map[string]bool{}
+		for _, scheme := range splitCommaSeparated(v) {
+			mediaURLAllowedSchemes[strings.ToLower(scheme)] = true
+		}
+	}
+	if v, ok := os.LookupEnv(mediaURLAllowedHostsEnvKey); ok {
+		for _, host := range splitCommaSeparated(v) {
+			mediaURLAllowedHosts = append(mediaURLAllowedHosts, strings.ToLower(host))
+		}
+	}
+	if v, ok := os.LookupEnv(inspectPlaylistEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as bool: %+v", inspectPlaylistEnvKey, err)
+		}
+		inspectPlaylistEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(ingestSecretEnvKey); ok {
+		ingestSecret = v
+	}
+	if v, ok := os.LookupEnv(waitlistDeadlineEnvKey); ok {
+		deadline, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as integer: %+v", waitlistDeadlineEnvKey, err)
+		}
+		waitlistDeadline = deadline
+	}
+}
+
+func splitCommaSeparated(v string) []string {
+	values := []string{}
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
 type InitializeResponse struct {
@@ -153,21 +236,6 @@ func initializeHandler(c echo.Context) error {
 				usersByNameCache.Store(user.Name, user)
 			}
 		}()
-
-		go func() {
-			context := context.Background()
-
-			var tags []TagModel
-			err := dbConn.SelectContext(context, &tags, "SELECT * FROM tags")
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			for _, tag := range tags {
-				tagsCache.Store(tag.ID, tag)
-			}
-		}()
 	}
 
 	cacheLock.Lock()
@@ -178,10 +246,30 @@ func initializeHandler(c echo.Context) error {
 	iconHashCache = sync.Map{}
 	imageCache = sync.Map{}
 	tagsCache = sync.Map{}
+	tagsByNameCache = sync.Map{}
+	tagAliasesCache = sync.Map{}
 	livestreamCache = sync.Map{}
-	livestreamByKeyTagNameCache = sync.Map{}
 	reactionsCache = sync.Map{}
+	livestreamCollaboratorsCache = sync.Map{}
+	livestreamVariantsCache = sync.Map{}
+	thumbnailCache = sync.Map{}
+	livestreamInviteesCache = sync.Map{}
 	cacheLock.Unlock()
+	presence.Reset()
+	livestreamEvents.Reset()
+	recentLivecomments.Reset()
+	recentReactions.Reset()
+
+	// タグ一覧はキャッシュから返すので、どのホストでも同期的に読み込んでおく
+	if err := loadTagsCache(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+	if err := livestreamTagIndex.Load(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tag index: "+err.Error())
+	}
+	if err := trending.Load(c.Request().Context(), dbConn, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load trending: "+err.Error())
+	}
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -225,23 +313,54 @@ func main() {
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/trending", getTrendingHandler)
+	e.GET("/api/recommendations", getRecommendationsHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// reserve livestream series
+	e.POST("/api/livestream/series", reserveLivestreamSeriesHandler)
+	e.GET("/api/livestream/series/:series_id", getLivestreamSeriesHandler)
+	e.PATCH("/api/livestream/series/:series_id", updateLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/series/:series_id", cancelLivestreamSeriesHandler)
+	// キャンセル待ち
+	e.POST("/api/livestream/waitlist", joinReservationWaitlistHandler)
+	e.GET("/api/livestream/waitlist", getMyReservationWaitlistHandler)
+	e.DELETE("/api/livestream/waitlist/:entry_id", withdrawReservationWaitlistHandler)
+	// 予約枠の空き状況
+	e.GET("/api/reservation_slots", getReservationSlotsHandler)
+	e.GET("/api/reservation_slots/window", getReservationWindowHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.GET("/api/user/:username/livestream.ics", getUserLivestreamsCalendarHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// cancel livestream
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	// edit livestream
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	// サムネイル画像のアップロードと取得
+	e.POST("/api/livestream/:livestream_id/thumbnail", postThumbnailHandler)
+	e.GET("/api/livestream/:livestream_id/thumbnail", getThumbnailHandler)
+	// 配信用のストリームキーの取得と発行 (再発行すると古いキーは無効になる)
+	e.GET("/api/livestream/:livestream_id/stream_key", getLivestreamStreamKeyHandler)
+	e.POST("/api/livestream/:livestream_id/stream_key", rotateLivestreamStreamKeyHandler)
+	// 配信者による前倒し開始・延長・早期終了
+	e.POST("/api/livestream/:livestream_id/start", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/extend", extendLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/events", getLivestreamEventsHandler)
+	e.GET("/api/livestream/:livestream_id/chat", getLivestreamChatHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
@@ -251,16 +370,29 @@ func main() {
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
 
+	// コラボレーター
+	e.GET("/api/livestream/:livestream_id/collaborators", getLivestreamCollaboratorsHandler)
+	e.POST("/api/livestream/:livestream_id/collaborators/accept", acceptCollaborationHandler)
+	e.POST("/api/livestream/:livestream_id/collaborators/decline", declineCollaborationHandler)
+
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴中のハートビートと視聴者数
+	e.POST("/api/livestream/:livestream_id/heartbeat", postHeartbeatHandler)
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/me/collaborations", getMyCollaborationsHandler)
+	e.GET("/api/user/me/stream_key", getUserStreamKeyHandler)
+	e.POST("/api/user/me/stream_key", rotateUserStreamKeyHandler)
+	e.GET("/api/user/me/history", getMyWatchHistoryHandler)
+	e.DELETE("/api/user/me/history", clearMyWatchHistoryHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
@@ -270,10 +402,25 @@ func main() {
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/analytics/retention", getLivestreamRetentionHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// admin
+	// タグ管理
+	e.POST("/api/admin/tag", postTagHandler)
+	e.PATCH("/api/admin/tag/:tag_id", updateTagHandler)
+	e.POST("/api/admin/tag/:tag_id/merge", mergeTagHandler)
+	e.DELETE("/api/admin/tag/:tag_id", deleteTagHandler)
+	e.POST("/api/admin/tag/:tag_id/aliases", postTagAliasHandler)
+	e.DELETE("/api/admin/tag/:tag_id/aliases/:alias_id", deleteTagAliasHandler)
+	// 予約枠の追加
+	e.PUT("/api/admin/reservation_slots", updateReservationSlotsHandler)
+
+	// メディアサーバ向けの内部API
+	e.POST("/internal/ingest/authorize", ingestAuthorizeHandler)
+
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
@@ -285,6 +432,20 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	if err := loadTagsCache(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
+	if err := livestreamTagIndex.Load(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load tag index: %v", err)
+		os.Exit(1)
+	}
+	if err := trending.Load(context.Background(), dbConn, time.Now().Unix()); err != nil {
+		e.Logger.Errorf("failed to load trending: %v", err)
+		os.Exit(1)
+	}
+	go presence.Run(dbConn)
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// プレイリストの取得にかける時間と、読み込む大きさの上限
+	playlistFetchTimeout = 3 * time.Second
+	maxPlaylistBytes     = 1 << 20
+	maxPlaylistRedirects = 10
+)
+
+type PlaylistVariant struct {
+	Bandwidth        int64  `json:"bandwidth"`
+	AverageBandwidth int64  `json:"average_bandwidth,omitempty"`
+	Width            int64  `json:"width,omitempty"`
+	Height           int64  `json:"height,omitempty"`
+	Codecs           string `json:"codecs,omitempty"`
+}
+
+type LivestreamPlaylistVariantModel struct {
+	ID               int64  `db:"id"`
+	LivestreamID     int64  `db:"livestream_id"`
+	Bandwidth        int64  `db:"bandwidth"`
+	AverageBandwidth int64  `db:"average_bandwidth"`
+	Width            int64  `db:"width"`
+	Height           int64  `db:"height"`
+	Codecs           string `db:"codecs"`
+}
+
+// ユーザが指定したURLを取得するので、内部のアドレスには接続しない
+// 接続先はDNSで解決した後のアドレスで確認し、リダイレクト先のURLも毎回検証する
+var playlistHTTPClient = &http.Client{
+	Timeout: playlistFetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: playlistFetchTimeout,
+			Control: rejectInternalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: playlistFetchTimeout,
+	},
+	CheckRedirect: checkPlaylistRedirect,
+}
+
+func rejectInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("connecting to %s is not allowed", host)
+	}
+	return nil
+}
+
+// ループバック・プライベート・リンクローカルなど、外部のメディアサーバではないアドレス
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+func checkPlaylistRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxPlaylistRedirects {
+		return errors.New("too many redirects")
+	}
+	return validateMediaURL("playlist_url", req.URL.String())
+}
+
+// プレイリストやサムネイルのURLが、許可されたスキームとホストを指しているか検証する
+func validateMediaURL(field, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, field+" must be an absolute URL")
+	}
+	if !mediaURLAllowedSchemes[strings.ToLower(u.Scheme)] {
+		return echo.NewHTTPError(http.StatusBadRequest, field+" has a scheme that is not allowed")
+	}
+	if !isAllowedMediaHost(u.Hostname()) {
+		return echo.NewHTTPError(http.StatusBadRequest, field+" has a host that is not allowed")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && isInternalIP(ip) {
+		return echo.NewHTTPError(http.StatusBadRequest, field+" has a host that is not allowed")
+	}
+	return nil
+}
+
+// 許可リストが空なら全てのホストを許可する
+// "*.example.com" はサブドメインに一致する
+func isAllowedMediaHost(host string) bool {
+	if len(mediaURLAllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range mediaURLAllowedHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func validateLivestreamMediaURLs(playlistURL, thumbnailURL string) error {
+	if err := validateMediaURL("playlist_url", playlistURL); err != nil {
+		return err
+	}
+	return validateMediaURL("thumbnail_url", thumbnailURL)
+}
+
+// 編集リクエストに含まれるURLを検証し、プレイリストが変わる場合は検査する
+// livestreamIDの配信にアップロードされた画像のURLは、サムネイルとしてそのまま受け付ける (0なら受け付けない)
+func inspectLivestreamUpdate(ctx context.Context, req *UpdateLivestreamRequest, livestreamID int64) ([]PlaylistVariant, error) {
+	if req.ThumbnailUrl != nil && !(livestreamID != 0 && isHostedThumbnailURL(livestreamID, *req.ThumbnailUrl)) {
+		if err := validateMediaURL("thumbnail_url", *req.ThumbnailUrl); err != nil {
+			return nil, err
+		}
+	}
+	if req.PlaylistUrl == nil {
+		return nil, nil
+	}
+	if err := validateMediaURL("playlist_url", *req.PlaylistUrl); err != nil {
+		return nil, err
+	}
+	return inspectPlaylist(ctx, *req.PlaylistUrl)
+}
+
+// プレイリストを取得し、HLSのプレイリストであることを確認して画質ごとの情報を返す
+// 検査が無効な場合はnilを返す
+func inspectPlaylist(ctx context.Context, playlistURL string) ([]PlaylistVariant, error) {
+	if !inspectPlaylistEnabled {
+		return nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "playlist_url is invalid: "+err.Error())
+	}
+	res, err := playlistHTTPClient.Do(req)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to fetch playlist: "+err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to fetch playlist: status %d", res.StatusCode))
+	}
+
+	playlist, err := parseHLSPlaylist(io.LimitReader(res.Body, maxPlaylistBytes))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "playlist_url is not a valid HLS playlist: "+err.Error())
+	}
+
+	variants := make([]PlaylistVariant, len(playlist.Variants))
+	for i, v := range playlist.Variants {
+		variants[i] = PlaylistVariant{
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Width:            v.Width,
+			Height:           v.Height,
+			Codecs:           v.Codecs,
+		}
+	}
+	return variants, nil
+}
+
+// 配信の画質ごとの情報を置き換える
+func replaceLivestreamVariants(ctx context.Context, tx *sqlx.Tx, livestreamID int64, variants []PlaylistVariant) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_playlist_variants WHERE livestream_id = ?", livestreamID); err != nil {
+		return err
+	}
+	for _, v := range variants {
+		variantModel := LivestreamPlaylistVariantModel{
+			LivestreamID:     livestreamID,
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Width:            v.Width,
+			Height:           v.Height,
+			Codecs:           v.Codecs,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_playlist_variants (livestream_id, bandwidth, average_bandwidth, width, height, codecs) VALUES (:livestream_id, :bandwidth, :average_bandwidth, :width, :height, :codecs)", variantModel); err != nil {
+			return err
+		}
+	}
+	livestreamVariantsCache.Delete(livestreamID)
+	return nil
+}
+
+func getLivestreamVariants(ctx context.Context, tx db, livestreamID int64) ([]PlaylistVariant, error) {
+	if cached, ok := livestreamVariantsCache.Load(livestreamID); ok {
+		return cached.([]PlaylistVariant), nil
+	}
+
+	var variantModels []*LivestreamPlaylistVariantModel
+	if err := tx.SelectContext(ctx, &variantModels, "SELECT * FROM livestream_playlist_variants WHERE livestream_id = ? ORDER BY bandwidth DESC", livestreamID); err != nil {
+		return nil, err
+	}
+	variants := make([]PlaylistVariant, len(variantModels))
+	for i, v := range variantModels {
+		variants[i] = PlaylistVariant{
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Width:            v.Width,
+			Height:           v.Height,
+			Codecs:           v.Codecs,
+		}
+	}
+	livestreamVariantsCache.Store(livestreamID, variants)
+	return variants, nil
+}
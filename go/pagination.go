@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageSize = 20
+	// サーバ側で強制する1ページあたりの最大件数
+	maxPageSize = 100
+	// limitをmaxPageSizeに切り詰めた場合に、切り詰めた件数を返すヘッダ
+	clampedLimitHeader = "X-Clamped-Limit"
+)
+
+// クライアントには不透明な文字列として渡すカーソル
+// IDの降順で並ぶ一覧ではLastID、関連度順の検索結果ではOffsetを使う
+type pageCursor struct {
+	LastID int64 `json:"last_id,omitempty"`
+	Offset int   `json:"offset,omitempty"`
+}
+
+type pageRequest struct {
+	Cursor pageCursor
+	Limit  int
+}
+
+type Page[T any] struct {
+	Items []T `json:"items"`
+	// 次のページがない場合は空文字
+	NextCursor string `json:"next_cursor"`
+}
+
+// ?cursor=&limit= を解釈する
+// 後方互換のため、cursorが指定されていない場合はnilを返し、従来通り配列で返す
+func parsePageRequest(c echo.Context) (*pageRequest, error) {
+	if !c.QueryParams().Has("cursor") {
+		return nil, nil
+	}
+
+	page := &pageRequest{Limit: defaultPageSize}
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		page.Limit = min(limit, maxPageSize)
+	}
+
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		if err := json.Unmarshal(b, &page.Cursor); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+	}
+
+	return page, nil
+}
+
+// cursorを指定しない従来の配列で返す一覧の件数
+// limitが指定されていなければ、従来通り全件を返すのでokがfalseになる
+// maxPageSizeを超えるlimitは切り詰め、切り詰めたことをclampedLimitHeaderで知らせる
+func parseLegacyLimit(c echo.Context) (limit int, ok bool, err error) {
+	if c.QueryParam("limit") == "" {
+		return 0, false, nil
+	}
+	limit, err = strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 0 {
+		return 0, false, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+	}
+	if limit > maxPageSize {
+		c.Response().Header().Set(clampedLimitHeader, strconv.Itoa(maxPageSize))
+		limit = maxPageSize
+	}
+	return limit, true, nil
+}
+
+func encodePageCursor(cursor pageCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 次のページがあるかを判定するため、1件多く取得する
+func (p *pageRequest) fetchLimit() int {
+	return p.Limit + 1
+}
+
+// IDの降順で並ぶ一覧で、カーソルより後ろを取得するための条件
+func (p *pageRequest) idCondition(column string) (string, []interface{}) {
+	if p.Cursor.LastID == 0 {
+		return "", nil
+	}
+	return " AND " + column + " < ?", []interface{}{p.Cursor.LastID}
+}
+
+// fetchLimit件で取得した結果から、返却する件数と次のページのカーソルを決める
+func (p *pageRequest) paginateByID(fetched int, idAt func(i int) int64) (int, string) {
+	if fetched <= p.Limit {
+		return fetched, ""
+	}
+	return p.Limit, encodePageCursor(pageCursor{LastID: idAt(p.Limit - 1)})
+}
+
+// 関連度順など、IDで並ばない一覧のためのオフセットによるページング
+func (p *pageRequest) paginateByOffset(fetched int) (int, string) {
+	if fetched <= p.Limit {
+		return fetched, ""
+	}
+	return p.Limit, encodePageCursor(pageCursor{Offset: p.Cursor.Offset + p.Limit})
+}
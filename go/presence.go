@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// この秒数ハートビートがなければ視聴をやめたものとみなす
+	presenceTimeout = 30
+	// クライアントに案内するハートビートの間隔
+	presenceHeartbeatInterval = 10
+	// 最大同時視聴者数・ユニーク視聴者をDBに書き出す間隔
+	presenceFlushInterval = 10 * time.Second
+)
+
+type LivestreamViewerStatsModel struct {
+	LivestreamID  int64 `db:"livestream_id"`
+	PeakViewers   int64 `db:"peak_viewers"`
+	UniqueViewers int64 `db:"unique_viewers"`
+	UpdatedAt     int64 `db:"updated_at"`
+}
+
+type LivestreamViewerCounts struct {
+	// 現在の同時視聴者数
+	Current int64 `json:"current"`
+	// 最大同時視聴者数
+	Peak int64 `json:"peak"`
+	// 一度でも視聴したユーザの数
+	Unique int64 `json:"unique"`
+}
+
+type presenceFlushEntry struct {
+	stats   LivestreamViewerStatsModel
+	viewers []int64
+}
+
+type livestreamPresence struct {
+	// ユーザID→最後にハートビートを受け取った時刻
+	lastSeen map[int64]int64
+	peak     int64
+	unique   map[int64]bool
+	// まだDBに書き出していないユニーク視聴者
+	pendingViewers []int64
+	dirty          bool
+	// restoreで作り直したものはDBから読み込むまでfalse
+	loaded bool
+}
+
+// 配信ごとの視聴者をハートビートでメモリ上に管理し、定期的にDBへ書き出す
+// メモリにない配信は、最初のハートビートの時にDBから読み込む
+type presenceTracker struct {
+	mu          sync.Mutex
+	livestreams map[int64]*livestreamPresence
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		livestreams: map[int64]*livestreamPresence{},
+	}
+}
+
+func (p *presenceTracker) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.livestreams = map[int64]*livestreamPresence{}
+}
+
+// 視聴中であることを記録し、現在の視聴者数を返す
+func (p *presenceTracker) Heartbeat(ctx context.Context, tx db, livestreamID, userID, now int64) (LivestreamViewerCounts, error) {
+	var lp *livestreamPresence
+	for {
+		var err error
+		lp, err = p.ensure(ctx, tx, livestreamID)
+		if err != nil {
+			return LivestreamViewerCounts{}, err
+		}
+		p.mu.Lock()
+		// ensureの後にFlushでメモリから外されていたら、読み込み直す
+		if p.livestreams[livestreamID] == lp {
+			break
+		}
+		p.mu.Unlock()
+	}
+	defer p.mu.Unlock()
+
+	lp.expire(now)
+	lp.lastSeen[userID] = now
+	if !lp.unique[userID] {
+		lp.unique[userID] = true
+		lp.pendingViewers = append(lp.pendingViewers, userID)
+		lp.dirty = true
+	}
+	if current := int64(len(lp.lastSeen)); current > lp.peak {
+		lp.peak = current
+		lp.dirty = true
+	}
+	return lp.counts(), nil
+}
+
+// 退室したユーザを視聴者から外す
+func (p *presenceTracker) Leave(livestreamID, userID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lp, ok := p.livestreams[livestreamID]; ok {
+		delete(lp.lastSeen, userID)
+	}
+}
+
+// メモリになければDBに書き出した値を返す (現在の視聴者数は0)
+func (p *presenceTracker) Counts(ctx context.Context, tx db, livestreamID, now int64) (LivestreamViewerCounts, error) {
+	p.mu.Lock()
+	if lp, ok := p.livestreams[livestreamID]; ok && lp.loaded {
+		defer p.mu.Unlock()
+		lp.expire(now)
+		return lp.counts(), nil
+	}
+	p.mu.Unlock()
+
+	statsModel, err := getLivestreamViewerStats(ctx, tx, livestreamID)
+	if err != nil {
+		return LivestreamViewerCounts{}, err
+	}
+	return LivestreamViewerCounts{Peak: statsModel.PeakViewers, Unique: statsModel.UniqueViewers}, nil
+}
+
+func (p *presenceTracker) ensure(ctx context.Context, tx db, livestreamID int64) (*livestreamPresence, error) {
+	p.mu.Lock()
+	lp, ok := p.livestreams[livestreamID]
+	p.mu.Unlock()
+	if ok && lp.loaded {
+		return lp, nil
+	}
+
+	// DBの読み込み中はロックを取らない
+	statsModel, err := getLivestreamViewerStats(ctx, tx, livestreamID)
+	if err != nil {
+		return nil, err
+	}
+	var viewerIDs []int64
+	if err := tx.SelectContext(ctx, &viewerIDs, "SELECT user_id FROM livestream_unique_viewers WHERE livestream_id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+	loaded := &livestreamPresence{
+		lastSeen: map[int64]int64{},
+		peak:     statsModel.PeakViewers,
+		unique:   make(map[int64]bool, len(viewerIDs)),
+		loaded:   true,
+	}
+	for _, viewerID := range viewerIDs {
+		loaded.unique[viewerID] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lp, ok = p.livestreams[livestreamID]
+	if !ok {
+		p.livestreams[livestreamID] = loaded
+		return loaded, nil
+	}
+	if !lp.loaded {
+		// restoreで作り直したものに、DBの値をまとめる
+		for viewerID := range loaded.unique {
+			lp.unique[viewerID] = true
+		}
+		lp.peak = max(lp.peak, loaded.peak)
+		lp.loaded = true
+	}
+	return lp, nil
+}
+
+// 変更のあった配信を書き出し、視聴者のいなくなった配信をメモリから外す
+func (p *presenceTracker) Flush(ctx context.Context, dbConn *sqlx.DB, now int64) error {
+	var entries []presenceFlushEntry
+
+	p.mu.Lock()
+	for livestreamID, lp := range p.livestreams {
+		lp.expire(now)
+		if lp.dirty {
+			entries = append(entries, presenceFlushEntry{
+				stats: LivestreamViewerStatsModel{
+					LivestreamID:  livestreamID,
+					PeakViewers:   lp.peak,
+					UniqueViewers: int64(len(lp.unique)),
+					UpdatedAt:     now,
+				},
+				viewers: lp.pendingViewers,
+			})
+			lp.pendingViewers = nil
+			lp.dirty = false
+		} else if len(lp.lastSeen) == 0 {
+			delete(p.livestreams, livestreamID)
+		}
+	}
+	p.mu.Unlock()
+
+	for i, entry := range entries {
+		if err := writeLivestreamViewerStats(ctx, dbConn, &entry.stats, entry.viewers); err != nil {
+			// 書き出せなかった分は次回に回す
+			p.restore(entries[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *presenceTracker) restore(entries []presenceFlushEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, entry := range entries {
+		lp, ok := p.livestreams[entry.stats.LivestreamID]
+		if !ok {
+			// 書き出せなかった視聴者を落とさないよう作り直す
+			// DBの値は次にensureした時にまとめる
+			lp = &livestreamPresence{
+				lastSeen: map[int64]int64{},
+				peak:     entry.stats.PeakViewers,
+				unique:   make(map[int64]bool, len(entry.viewers)),
+			}
+			for _, viewerID := range entry.viewers {
+				lp.unique[viewerID] = true
+			}
+			p.livestreams[entry.stats.LivestreamID] = lp
+		}
+		lp.pendingViewers = append(lp.pendingViewers, entry.viewers...)
+		lp.dirty = true
+	}
+}
+
+// presenceFlushIntervalごとにFlushし続ける
+func (p *presenceTracker) Run(dbConn *sqlx.DB) {
+	ticker := time.NewTicker(presenceFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.Flush(context.Background(), dbConn, time.Now().Unix()); err != nil {
+			log.Printf("failed to flush viewer presence: %+v", err)
+		}
+	}
+}
+
+func (lp *livestreamPresence) expire(now int64) {
+	for userID, lastSeen := range lp.lastSeen {
+		if lastSeen <= now-presenceTimeout {
+			delete(lp.lastSeen, userID)
+		}
+	}
+}
+
+func (lp *livestreamPresence) counts() LivestreamViewerCounts {
+	return LivestreamViewerCounts{
+		Current: int64(len(lp.lastSeen)),
+		Peak:    lp.peak,
+		Unique:  int64(len(lp.unique)),
+	}
+}
+
+// まだ書き出されていなければ0を返す
+func getLivestreamViewerStats(ctx context.Context, tx db, livestreamID int64) (*LivestreamViewerStatsModel, error) {
+	statsModel := &LivestreamViewerStatsModel{LivestreamID: livestreamID}
+	if err := tx.GetContext(ctx, statsModel, "SELECT * FROM livestream_viewer_stats WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return statsModel, nil
+}
+
+func writeLivestreamViewerStats(ctx context.Context, dbConn *sqlx.DB, statsModel *LivestreamViewerStatsModel, viewerIDs []int64) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, viewerID := range viewerIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_unique_viewers (livestream_id, user_id) VALUES (?, ?)", statsModel.LivestreamID, viewerID); err != nil {
+			return err
+		}
+	}
+	// 他のホストが記録した視聴者も含めて数え直す
+	if err := tx.GetContext(ctx, &statsModel.UniqueViewers, "SELECT COUNT(*) FROM livestream_unique_viewers WHERE livestream_id = ?", statsModel.LivestreamID); err != nil {
+		return err
+	}
+	// 最大同時視聴者数は、他のホストが書き出した値より小さくしない
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewer_stats (livestream_id, peak_viewers, unique_viewers, updated_at) VALUES (:livestream_id, :peak_viewers, :unique_viewers, :updated_at) ON DUPLICATE KEY UPDATE peak_viewers = GREATEST(peak_viewers, VALUES(peak_viewers)), unique_viewers = VALUES(unique_viewers), updated_at = VALUES(updated_at)", statsModel); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -41,35 +44,103 @@ func getReactionsHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+	since, err := parseSinceRequest(c)
+	if err != nil {
+		return err
+	}
+	if since != nil && page != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "since_id and since_ts can't be used with cursor")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
+	if _, err := getViewableLivestream(ctx, tx, livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// 差分取得はメモリ上の直近の投稿から返し、新しく投稿された分だけを詰める
+	if since != nil {
+		reactionModels, ok, err := recentReactions.Since(ctx, int64(livestreamID), since)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+		}
+		if !ok {
+			if err := tx.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? AND id > ? AND created_at >= ? ORDER BY id", livestreamID, since.ID, since.Timestamp); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+			}
+		}
+		reactionModels, err = sinceItemsResponse(c, reactionModels)
+		if err != nil {
+			return err
+		}
+
+		reactions := make([]Reaction, len(reactionModels))
+		for i := range reactionModels {
+			reaction, err := fillReactionResponse(ctx, tx, reactionModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+			}
+			reactions[i] = reaction
+		}
+
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, reactions)
+	}
+
 	// index
 	reactionModels := []ReactionModel{}
 	cachedReactions, ok := reactionsCache.Load(livestreamID)
 	if ok {
 		reactionModels = cachedReactions.([]ReactionModel)
 	} else {
-		if err := tx.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC", livestreamID); err != nil {
+		if err := tx.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY id DESC", livestreamID); err != nil {
 			return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 		}
 		reactionsCache.Store(livestreamID, reactionModels)
 	}
 
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+	nextCursor := ""
+	if page != nil {
+		// キャッシュはIDの降順 (作成日時の降順) に並んでいるので、カーソルより後ろを切り出す
+		start := 0
+		if page.Cursor.LastID != 0 {
+			start = sort.Search(len(reactionModels), func(i int) bool { return reactionModels[i].ID < page.Cursor.LastID })
+		}
+		end := min(start+page.fetchLimit(), len(reactionModels))
+		reactionModels = reactionModels[start:end]
+
+		var n int
+		n, nextCursor = page.paginateByID(len(reactionModels), func(i int) int64 { return reactionModels[i].ID })
+		reactionModels = reactionModels[:n]
+	} else {
+		limit, ok, err := parseLegacyLimit(c)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return err
 		}
-		if len(reactionModels) > limit {
+		if ok && len(reactionModels) > limit {
 			reactionModels = reactionModels[:limit]
 		}
 	}
@@ -88,6 +159,9 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if page != nil {
+		return c.JSON(http.StatusOK, Page[Reaction]{Items: reactions, NextCursor: nextCursor})
+	}
 	return c.JSON(http.StatusOK, reactions)
 }
 
@@ -113,12 +187,31 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	reaction, err := createReaction(ctx, c.Logger(), userID, livestreamID, req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// リアクションを投稿し、購読者に配信する
+// HTTPとWebSocketの両方から使うので、エラーはecho.NewHTTPErrorで返す
+// 配信に失敗しても投稿は成功しているので、loggerに残すだけにする
+func createReaction(ctx context.Context, logger echo.Logger, userID int64, livestreamID int, req *PostReactionRequest) (Reaction, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
+	if _, err := getViewableLivestream(ctx, tx, livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Reaction{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -128,27 +221,32 @@ func postReactionHandler(c echo.Context) error {
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
 
 	reactionID, err := result.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
 	}
 	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
 	reactionsCache.Delete(livestreamID)
+	recentReactions.Add(reactionModel.LivestreamID, reactionModel)
+	trending.Record(reactionModel.LivestreamID, trendingReactionWeight, reactionModel.CreatedAt)
+	if err := livestreamEvents.Publish(reactionModel.LivestreamID, livestreamEventReaction, reaction); err != nil {
+		logger.Warnf("failed to publish reaction event: %v", err)
+	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	return reaction, nil
 }
 
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
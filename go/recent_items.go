@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ごとにメモリに保持する直近のライブコメント・リアクションの数
+const recentItemBufferSize = 200
+
+// ?since_id= と ?since_ts= による差分取得の条件
+type sinceRequest struct {
+	// このIDより後に投稿されたもの
+	ID int64
+	// この時刻以降に投稿されたもの (同じ秒の投稿を取りこぼさないよう、この時刻を含む)
+	Timestamp int64
+}
+
+// since_idもsince_tsも指定されていなければnilを返す
+func parseSinceRequest(c echo.Context) (*sinceRequest, error) {
+	sinceIDParam := c.QueryParam("since_id")
+	sinceTsParam := c.QueryParam("since_ts")
+	if sinceIDParam == "" && sinceTsParam == "" {
+		return nil, nil
+	}
+
+	since := &sinceRequest{}
+	if sinceIDParam != "" {
+		id, err := strconv.ParseInt(sinceIDParam, 10, 64)
+		if err != nil || id < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "since_id query parameter must be non-negative integer")
+		}
+		since.ID = id
+	}
+	if sinceTsParam != "" {
+		ts, err := strconv.ParseInt(sinceTsParam, 10, 64)
+		if err != nil || ts < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "since_ts query parameter must be non-negative integer")
+		}
+		since.Timestamp = ts
+	}
+	return since, nil
+}
+
+type recentItems[T any] struct {
+	// IDの昇順
+	items []T
+	// このIDより大きいものは全てitemsにある
+	floorID int64
+	loaded  bool
+}
+
+// 配信ごとに直近の投稿をrecentItemBufferSize件までIDの昇順で保持する
+// 読み込まれていない配信は、最初に参照された時にDBから直近の分を読み込む
+type recentItemBuffer[T any] struct {
+	mu          sync.Mutex
+	livestreams map[int64]*recentItems[T]
+	// 直近limit件をIDの降順で返す
+	load      func(ctx context.Context, livestreamID int64, limit int) ([]T, error)
+	id        func(T) int64
+	createdAt func(T) int64
+}
+
+func newRecentItemBuffer[T any](load func(ctx context.Context, livestreamID int64, limit int) ([]T, error), id func(T) int64, createdAt func(T) int64) *recentItemBuffer[T] {
+	return &recentItemBuffer[T]{
+		livestreams: map[int64]*recentItems[T]{},
+		load:        load,
+		id:          id,
+		createdAt:   createdAt,
+	}
+}
+
+func (b *recentItemBuffer[T]) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.livestreams = map[int64]*recentItems[T]{}
+}
+
+// 投稿をコミットした後に呼ぶ
+// 誰も参照していない配信は読み込み時にDBから取れるので、何もしない
+func (b *recentItemBuffer[T]) Add(livestreamID int64, item T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.livestreams[livestreamID]
+	if !ok {
+		return
+	}
+	b.merge(r, []T{item})
+}
+
+// 削除された投稿をバッファから外す
+func (b *recentItemBuffer[T]) Remove(livestreamID int64, ids []int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.livestreams[livestreamID]
+	if !ok {
+		return
+	}
+	if !r.loaded {
+		// 読み込み中のDBのスナップショットに削除前のものが含まれうるので、読み込みからやり直す
+		delete(b.livestreams, livestreamID)
+		return
+	}
+	removed := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+	items := r.items[:0]
+	for _, item := range r.items {
+		if !removed[b.id(item)] {
+			items = append(items, item)
+		}
+	}
+	r.items = items
+}
+
+// 条件に合う投稿をIDの昇順で返す
+// バッファから溢れていて全ては返せない場合はokがfalseになるので、DBから取得する
+func (b *recentItemBuffer[T]) Since(ctx context.Context, livestreamID int64, since *sinceRequest) ([]T, bool, error) {
+	r, err := b.ensure(ctx, livestreamID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// ensureの後にRemoveやResetで外されていたら、削除を反映できていないのでDBから取得する
+	if b.livestreams[livestreamID] != r {
+		return nil, false, nil
+	}
+	complete := since.ID >= r.floorID || (len(r.items) > 0 && b.createdAt(r.items[0]) < since.Timestamp)
+	if !complete {
+		return nil, false, nil
+	}
+	start := sort.Search(len(r.items), func(i int) bool { return b.id(r.items[i]) > since.ID })
+	items := []T{}
+	for _, item := range r.items[start:] {
+		if b.createdAt(item) >= since.Timestamp {
+			items = append(items, item)
+		}
+	}
+	return items, true, nil
+}
+
+func (b *recentItemBuffer[T]) ensure(ctx context.Context, livestreamID int64) (*recentItems[T], error) {
+	b.mu.Lock()
+	r, ok := b.livestreams[livestreamID]
+	if ok && r.loaded {
+		b.mu.Unlock()
+		return r, nil
+	}
+	if !ok {
+		// 読み込み中に投稿されたものはAddで積んでおき、読み込んだものとまとめる
+		r = &recentItems[T]{}
+		b.livestreams[livestreamID] = r
+	}
+	b.mu.Unlock()
+
+	// DBの読み込み中はロックを取らない
+	loaded, err := b.load(ctx, livestreamID, recentItemBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current, ok := b.livestreams[livestreamID]; !ok || current != r {
+		// 読み込み中に外されたので、今回読み込んだ分だけで返す
+		r = &recentItems[T]{}
+	}
+	if r.loaded {
+		return r, nil
+	}
+	if len(loaded) == recentItemBufferSize {
+		r.floorID = max(r.floorID, b.id(loaded[len(loaded)-1])-1)
+	}
+	b.merge(r, loaded)
+	r.loaded = true
+	return r, nil
+}
+
+// IDの重複を除いて昇順に並べ、floorID以下のものと溢れた古いものを捨てる
+func (b *recentItemBuffer[T]) merge(r *recentItems[T], items []T) {
+	merged := make([]T, 0, len(r.items)+len(items))
+	seen := make(map[int64]bool, len(r.items)+len(items))
+	for _, item := range append(r.items, items...) {
+		if id := b.id(item); !seen[id] && id > r.floorID {
+			seen[id] = true
+			merged = append(merged, item)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return b.id(merged[i]) < b.id(merged[j]) })
+	if overflow := len(merged) - recentItemBufferSize; overflow > 0 {
+		r.floorID = b.id(merged[overflow-1])
+		merged = merged[overflow:]
+	}
+	r.items = merged
+}
+
+// 差分取得の結果をlimitで切り詰め、他の一覧と同じくIDの降順にする
+// limitを超える場合は古い方から返すので、返した中で最大のIDを次のsince_idにすれば続きを取得できる
+func sinceItemsResponse[T any](c echo.Context, items []T) ([]T, error) {
+	limit, ok, err := parseLegacyLimit(c)
+	if err != nil {
+		return nil, err
+	}
+	if ok && len(items) > limit {
+		items = items[:limit]
+	}
+	slices.Reverse(items)
+	return items, nil
+}
+
+func loadRecentLivecomments(ctx context.Context, livestreamID int64, limit int) ([]LivecommentModel, error) {
+	var livecommentModels []LivecommentModel
+	if err := dbConn.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY id DESC LIMIT ?", livestreamID, limit); err != nil {
+		return nil, err
+	}
+	return livecommentModels, nil
+}
+
+func loadRecentReactions(ctx context.Context, livestreamID int64, limit int) ([]ReactionModel, error) {
+	var reactionModels []ReactionModel
+	if err := dbConn.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY id DESC LIMIT ?", livestreamID, limit); err != nil {
+		return nil, err
+	}
+	return reactionModels, nil
+}
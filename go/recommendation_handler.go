@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 行動ごとの重み
+	recommendationViewWeight        = 1.0
+	recommendationReactionWeight    = 1.0
+	recommendationLivecommentWeight = 2.0
+
+	// 好みのタグ・配信者と、全体での盛り上がりの重み
+	recommendationTagWeight      = 1.0
+	recommendationStreamerWeight = 2.0
+	recommendationTrendingWeight = 0.1
+
+	// 好みを求めるために遡る、行動の種類ごとの件数
+	recommendationHistoryLimit = 1000
+)
+
+type RecommendedLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	Score      float64    `json:"score"`
+}
+
+type recommendationInteraction struct {
+	LivestreamID int64 `db:"livestream_id"`
+	Tip          int64 `db:"tip"`
+}
+
+// ユーザの好みのタグと配信者
+type userAffinity struct {
+	Tags      map[int64]float64
+	Streamers map[int64]float64
+}
+
+func (a *userAffinity) isEmpty() bool {
+	return len(a.Tags) == 0 && len(a.Streamers) == 0
+}
+
+// おすすめ配信の取得API
+// 予定・配信中の配信を、視聴履歴やリアクション・ライブコメントから求めた好みで順位付けする
+// GET /api/recommendations?limit=
+func getRecommendationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultPageSize
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	affinity, err := getUserAffinity(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user affinity: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	var candidates []*LivestreamModel
+	if err := tx.SelectContext(ctx, &candidates, "SELECT * FROM livestreams WHERE canceled_at = 0 AND end_at > ? AND user_id != ? AND visibility = ?", now, userID, livestreamVisibilityPublic); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	// 盛り上がりは最大が1になるように正規化する
+	trendingScores := map[int64]float64{}
+	topLivestreams := trending.TopLivestreams(now)
+	for _, entry := range topLivestreams {
+		trendingScores[entry.ID] = entry.Score / topLivestreams[0].Score
+	}
+
+	// 好みが分からないユーザには、全体での盛り上がりだけで順位付けする
+	coldStart := affinity.isEmpty()
+	scores := make(map[int64]float64, len(candidates))
+	for _, candidate := range candidates {
+		score := trendingScores[candidate.ID] * recommendationTrendingWeight
+		if coldStart {
+			score = trendingScores[candidate.ID]
+		} else {
+			for _, tagID := range livestreamTagIndex.TagsOf(candidate.ID) {
+				score += affinity.Tags[tagID] * recommendationTagWeight
+			}
+			score += affinity.Streamers[candidate.UserID] * recommendationStreamerWeight
+		}
+		scores[candidate.ID] = score
+	}
+	// 同点なら開始が近い順
+	sort.Slice(candidates, func(i, j int) bool {
+		if scores[candidates[i].ID] != scores[candidates[j].ID] {
+			return scores[candidates[i].ID] > scores[candidates[j].ID]
+		}
+		if candidates[i].StartAt != candidates[j].StartAt {
+			return candidates[i].StartAt < candidates[j].StartAt
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	recommendations := make([]RecommendedLivestream, len(candidates))
+	for i := range candidates {
+		livestream, err := fillLivestreamResponse(ctx, tx, *candidates[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		recommendations[i] = RecommendedLivestream{
+			Livestream: livestream,
+			Score:      scores[candidates[i].ID],
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, recommendations)
+}
+
+// 視聴・リアクション・ライブコメントした配信から、タグと配信者ごとの好みを求める
+// 合計が1になるように正規化する
+func getUserAffinity(ctx context.Context, tx *sqlx.Tx, userID int64) (*userAffinity, error) {
+	weights := map[int64]float64{}
+
+	// 退室しても残る視聴記録を使い、消去された履歴は使わない
+	clearedID, err := getWatchHistoryClearedID(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var views []*recommendationInteraction
+	if err := tx.SelectContext(ctx, &views, "SELECT livestream_id FROM watch_logs WHERE user_id = ? AND id > ? ORDER BY id DESC LIMIT ?", userID, clearedID, recommendationHistoryLimit); err != nil {
+		return nil, err
+	}
+	for _, view := range views {
+		weights[view.LivestreamID] += recommendationViewWeight
+	}
+
+	var reactions []*recommendationInteraction
+	if err := tx.SelectContext(ctx, &reactions, "SELECT livestream_id FROM reactions WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, recommendationHistoryLimit); err != nil {
+		return nil, err
+	}
+	for _, reaction := range reactions {
+		weights[reaction.LivestreamID] += recommendationReactionWeight
+	}
+
+	var livecomments []*recommendationInteraction
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT livestream_id, tip FROM livecomments WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, recommendationHistoryLimit); err != nil {
+		return nil, err
+	}
+	for _, livecomment := range livecomments {
+		weights[livecomment.LivestreamID] += recommendationLivecommentWeight + float64(livecomment.Tip)*trendingTipWeight
+	}
+
+	affinity := &userAffinity{
+		Tags:      map[int64]float64{},
+		Streamers: map[int64]float64{},
+	}
+	if len(weights) == 0 {
+		return affinity, nil
+	}
+
+	livestreamIDs := make([]int64, 0, len(weights))
+	for livestreamID := range weights {
+		livestreamIDs = append(livestreamIDs, livestreamID)
+	}
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return nil, err
+	}
+
+	var tagTotal, streamerTotal float64
+	for _, livestreamModel := range livestreamModels {
+		weight := weights[livestreamModel.ID]
+		// 自分の配信への行動は好みに含めない
+		if livestreamModel.UserID != userID {
+			affinity.Streamers[livestreamModel.UserID] += weight
+			streamerTotal += weight
+		}
+		for _, tagID := range livestreamTagIndex.TagsOf(livestreamModel.ID) {
+			affinity.Tags[tagID] += weight
+			tagTotal += weight
+		}
+	}
+	for tagID := range affinity.Tags {
+		affinity.Tags[tagID] /= tagTotal
+	}
+	for streamerID := range affinity.Streamers {
+		affinity.Streamers[streamerID] /= streamerTotal
+	}
+
+	return affinity, nil
+}
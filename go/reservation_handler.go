@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// 2023/11/25 10:00からの１年間が予約可能な期間
+	reservationTermStartAt = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	reservationTermEndAt   = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+
+	errReservationSlotUnavailable = errors.New("reservation slot is unavailable")
+)
+
+// 予約枠は1時間ごと
+const reservationSlotSeconds = int64(time.Hour / time.Second)
+
+type ReservationSlot struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type ReservationWindow struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+// 予約枠の空き状況取得API
+// GET /api/reservation_slots?from=&to=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be less than to")
+	}
+
+	var slotModels []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i := range slotModels {
+		slots[i] = ReservationSlot{
+			StartAt:   slotModels[i].StartAt,
+			EndAt:     slotModels[i].EndAt,
+			Remaining: slotModels[i].Slot,
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 指定時刻から連続して予約可能な最長の区間を取得するAPI
+// GET /api/reservation_slots/window?start_at=
+func getReservationWindowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	startAt, err := strconv.ParseInt(c.QueryParam("start_at"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at query parameter must be integer")
+	}
+
+	var slotModels []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? ORDER BY start_at", startAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	window, ok := findReservationWindow(slotModels, startAt)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no bookable reservation slot starts at the given time")
+	}
+
+	return c.JSON(http.StatusOK, window)
+}
+
+// start_atから始まり、残数が1以上の枠が途切れずに続く区間を返す
+// slotsはstart_atの昇順に並んでいること
+func findReservationWindow(slots []*ReservationSlotModel, startAt int64) (ReservationWindow, bool) {
+	window := ReservationWindow{StartAt: startAt, EndAt: startAt}
+	for _, slot := range slots {
+		if slot.StartAt != window.EndAt || slot.Slot < 1 {
+			break
+		}
+		if window.EndAt == window.StartAt || slot.Slot < window.Remaining {
+			window.Remaining = slot.Slot
+		}
+		window.EndAt = slot.EndAt
+	}
+	if window.EndAt == window.StartAt {
+		return ReservationWindow{}, false
+	}
+	return window, true
+}
+
+// 予約区間に含まれる枠の残数を1つずつ戻す
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt)
+	return err
+}
+
+// 予約区間が予約可能な期間と重なっているか
+func isValidReservationTerm(startAt, endAt int64) bool {
+	var (
+		reserveStartAt = time.Unix(startAt, 0)
+		reserveEndAt   = time.Unix(endAt, 0)
+	)
+	if (reserveStartAt.Equal(reservationTermEndAt) || reserveStartAt.After(reservationTermEndAt)) || (reserveEndAt.Equal(reservationTermStartAt) || reserveEndAt.Before(reservationTermStartAt)) {
+		return false
+	}
+	return true
+}
+
+// 予約区間に含まれる枠を1つずつ確保する
+// 残数がない枠が含まれる場合はerrReservationSlotUnavailableを返し、枠は変更しない
+func claimReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			return errReservationSlotUnavailable
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt)
+	return err
+}
+
+// 時刻を含む予約枠の開始時刻
+func reservationSlotStartAt(t int64) int64 {
+	return t - t%reservationSlotSeconds
+}
+
+func reservationUnavailableMessage(startAt, endAt int64) string {
+	return fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", reservationTermStartAt.Unix(), reservationTermEndAt.Unix(), startAt, endAt)
+}
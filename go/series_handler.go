@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	seriesRecurrenceWeekly = "weekly"
+
+	seriesAllocationAllOrNothing = "all_or_nothing"
+	seriesAllocationBestEffort   = "best_effort"
+
+	// 1シリーズで予約できる回数の上限
+	maxSeriesOccurrences = 52
+)
+
+type ReserveLivestreamSeriesRequest struct {
+	Tags         []int64 `json:"tags"`
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	PlaylistUrl  string  `json:"playlist_url"`
+	ThumbnailUrl string  `json:"thumbnail_url"`
+	// 初回の配信の開始・終了時刻。以降は毎週同じ曜日・時刻に配信する
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// OccurrencesとUntilのどちらかを指定する
+	Occurrences int64 `json:"occurrences"`
+	Until       int64 `json:"until"`
+	// all_or_nothing (default) または best_effort
+	Allocation string `json:"allocation"`
+	// 全ての回に同じ公開範囲と招待ユーザを設定する
+	Visibility string  `json:"visibility"`
+	Invitees   []int64 `json:"invitees"`
+}
+
+type LivestreamSeriesModel struct {
+	ID         int64  `db:"id"`
+	UserID     int64  `db:"user_id"`
+	Recurrence string `db:"recurrence"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+type LivestreamSeries struct {
+	ID          int64          `json:"id"`
+	Recurrence  string         `json:"recurrence"`
+	Livestreams []Livestream   `json:"livestreams"`
+	Skipped     []SeriesWindow `json:"skipped"`
+}
+
+type SeriesWindow struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+// 定期配信の予約API
+// POST /api/livestream/series
+func reserveLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if req.Allocation == "" {
+		req.Allocation = seriesAllocationAllOrNothing
+	}
+	if req.Allocation != seriesAllocationAllOrNothing && req.Allocation != seriesAllocationBestEffort {
+		return echo.NewHTTPError(http.StatusBadRequest, "allocation must be all_or_nothing or best_effort")
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+
+	windows, err := weeklySeriesWindows(req.StartAt, req.EndAt, req.Occurrences, req.Until)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateLivestreamMediaURLs(req.PlaylistUrl, req.ThumbnailUrl); err != nil {
+		return err
+	}
+	visibility, err := normalizeLivestreamVisibility(req.Visibility)
+	if err != nil {
+		return err
+	}
+	// 全ての回で同じプレイリストを使うので、検査は1回だけ行う
+	variants, err := inspectPlaylist(ctx, req.PlaylistUrl)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:     userID,
+		Recurrence: seriesRecurrenceWeekly,
+		CreatedAt:  time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, recurrence, created_at) VALUES (:user_id, :recurrence, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	series := LivestreamSeries{
+		ID:          seriesID,
+		Recurrence:  seriesModel.Recurrence,
+		Livestreams: []Livestream{},
+		Skipped:     []SeriesWindow{},
+	}
+	pendingTags := pendingLivestreamTags{}
+	for _, window := range windows {
+		if !isValidReservationTerm(window.StartAt, window.EndAt) {
+			if req.Allocation == seriesAllocationBestEffort {
+				series.Skipped = append(series.Skipped, window)
+				continue
+			}
+			return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+		}
+
+		if err := claimReservationSlots(ctx, tx, window.StartAt, window.EndAt); err != nil {
+			if errors.Is(err, errReservationSlotUnavailable) {
+				if req.Allocation == seriesAllocationBestEffort {
+					series.Skipped = append(series.Skipped, window)
+					continue
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, reservationUnavailableMessage(window.StartAt, window.EndAt))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		}
+
+		livestreamModel := &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      window.StartAt,
+			EndAt:        window.EndAt,
+			SeriesID:     seriesID,
+			Visibility:   visibility,
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		}
+		tags, err := insertLivestreamTags(ctx, tx, livestreamModel.ID, req.Tags)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+		}
+		pendingTags[livestreamModel.ID] = tags
+		if variants != nil {
+			if err := replaceLivestreamVariants(ctx, tx, livestreamModel.ID, variants); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream variants: "+err.Error())
+			}
+		}
+		if err := replaceLivestreamInvitees(ctx, tx, livestreamModel, req.Invitees); err != nil {
+			return err
+		}
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		series.Livestreams = append(series.Livestreams, livestream)
+	}
+
+	if len(series.Livestreams) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no occurrence of the series could be reserved")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	pendingTags.apply()
+
+	return c.JSON(http.StatusCreated, series)
+}
+
+// 定期配信の取得API
+// GET /api/livestream/series/:series_id
+func getLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream series that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? AND canceled_at = 0 ORDER BY start_at", seriesID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	// 閲覧できない非公開の回は除く
+	viewableModels := make([]*LivestreamModel, 0, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		canView, err := canViewLivestream(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+		if canView {
+			viewableModels = append(viewableModels, livestreamModel)
+		}
+	}
+	livestreamModels = viewableModels
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamSeries{
+		ID:          seriesModel.ID,
+		Recurrence:  seriesModel.Recurrence,
+		Livestreams: livestreams,
+		Skipped:     []SeriesWindow{},
+	})
+}
+
+// 定期配信の一括編集API
+// まだ開始していない配信のみが対象で、開始・終了時刻は変更できない
+// PATCH /api/livestream/series/:series_id
+func updateLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt != nil || req.EndAt != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't reschedule a series at once; reschedule each livestream instead")
+	}
+	// 他の配信者のシリーズでプレイリストを取得させないよう、所有者を確かめてから検査する
+	if err := checkLivestreamSeriesOwner(ctx, dbConn, seriesID, userID); err != nil {
+		return err
+	}
+	// どの回の画像か決まらないので、アップロードした画像のURLは受け付けない
+	variants, err := inspectLivestreamUpdate(ctx, req, 0)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := lockUpcomingSeriesLivestreams(ctx, tx, seriesID, userID)
+	if err != nil {
+		return err
+	}
+
+	pendingTags := pendingLivestreamTags{}
+	for _, livestreamModel := range livestreamModels {
+		if err := applyLivestreamUpdate(ctx, tx, livestreamModel, req, variants, pendingTags); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		evictLivestreamCache(livestreamModel.ID)
+	}
+	pendingTags.apply()
+
+	livestreams, err := fillCommittedLivestreamResponses(ctx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// 定期配信の一括キャンセルAPI
+// まだ開始していない配信をすべてキャンセルする
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModels, err := lockUpcomingSeriesLivestreams(ctx, tx, seriesID, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	pendingTags := pendingLivestreamTags{}
+	for _, livestreamModel := range livestreamModels {
+		if err := cancelLivestream(ctx, tx, livestreamModel, now, pendingTags); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		evictLivestreamCache(livestreamModel.ID)
+		livestreamTagIndex.Remove(livestreamModel.ID)
+	}
+	pendingTags.apply()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// シリーズの所有者を確認し、まだ開始していない配信を行ロックを取って取得する
+func lockUpcomingSeriesLivestreams(ctx context.Context, tx *sqlx.Tx, seriesID, userID int64) ([]*LivestreamModel, error) {
+	if err := checkLivestreamSeriesOwner(ctx, tx, seriesID, userID); err != nil {
+		return nil, err
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? AND canceled_at = 0 AND start_at > ? ORDER BY start_at FOR UPDATE", seriesID, time.Now().Unix()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	return livestreamModels, nil
+}
+
+func checkLivestreamSeriesOwner(ctx context.Context, tx db, seriesID, userID int64) error {
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream series that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream series")
+	}
+	return nil
+}
+
+// 初回の配信から1週間ごとの配信区間を列挙する
+func weeklySeriesWindows(startAt, endAt, occurrences, until int64) ([]SeriesWindow, error) {
+	if (occurrences > 0) == (until > 0) {
+		return nil, errors.New("either occurrences or until must be specified")
+	}
+
+	const week = int64(7 * 24 * time.Hour / time.Second)
+	windows := []SeriesWindow{}
+	for i := int64(0); ; i++ {
+		window := SeriesWindow{
+			StartAt: startAt + i*week,
+			EndAt:   endAt + i*week,
+		}
+		if occurrences > 0 && i >= occurrences {
+			break
+		}
+		if until > 0 && window.StartAt > until {
+			break
+		}
+		if len(windows) >= maxSeriesOccurrences {
+			return nil, errors.New("too many occurrences in a series")
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		return nil, errors.New("the series has no occurrence")
+	}
+
+	return windows, nil
+}
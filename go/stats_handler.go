@@ -7,8 +7,10 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,6 +20,8 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// ハートビートによる同時視聴者数・最大同時視聴者数・ユニーク視聴者数
+	Viewers LivestreamViewerCounts `json:"viewers"`
 }
 
 type LivestreamRankingEntry struct {
@@ -205,6 +209,11 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
 	id, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -217,7 +226,7 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	_, err = getLivestream(ctx, tx, int(livestreamID))
+	_, err = getViewableLivestream(ctx, tx, int(livestreamID), userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusBadRequest, "not found livestream that has the given id")
 	} else if err != nil {
@@ -320,6 +329,11 @@ GROUP BY l2.livestream_id
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
+	viewers, err := presence.Counts(ctx, tx, livestreamID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewer counts: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
@@ -330,6 +344,7 @@ GROUP BY l2.livestream_id
 		MaxTip:         maxTip,
 		TotalReactions: totalReactions,
 		TotalReports:   totalReports,
+		Viewers:        viewers,
 	})
 }
 
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamKeyPrefix = "sk_"
+	// 一覧で見分けられるように保存しておく、キーの先頭の文字数
+	streamKeyDisplayLength = 8
+)
+
+type StreamKeyModel struct {
+	ID     int64 `db:"id"`
+	UserID int64 `db:"user_id"`
+	// 0の場合は配信者の全ての配信で使えるキー
+	LivestreamID int64  `db:"livestream_id"`
+	KeyHash      string `db:"key_hash"`
+	KeyPrefix    string `db:"key_prefix"`
+	CreatedAt    int64  `db:"created_at"`
+	// 0の場合は有効
+	RevokedAt int64 `db:"revoked_at"`
+}
+
+type StreamKey struct {
+	ID           int64 `json:"id"`
+	LivestreamID int64 `json:"livestream_id,omitempty"`
+	// 発行直後のレスポンスにのみ含まれる
+	Key       string `json:"key,omitempty"`
+	KeyPrefix string `json:"key_prefix"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type IngestAuthorizeRequest struct {
+	StreamKey string `json:"stream_key"`
+	// 配信者のキーの場合は省略でき、その時刻に配信枠のある配信が選ばれる
+	LivestreamID int64 `json:"livestream_id"`
+}
+
+type IngestAuthorizeResponse struct {
+	Authorized   bool   `json:"authorized"`
+	LivestreamID int64  `json:"livestream_id,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// 配信用のストリームキーの取得API (キーそのものは返さない)
+// GET /api/livestream/:livestream_id/stream_key
+func getLivestreamStreamKeyHandler(c echo.Context) error {
+	return getStreamKey(c, true)
+}
+
+// 配信用のストリームキーの発行API。既存のキーは無効になる
+// POST /api/livestream/:livestream_id/stream_key
+func rotateLivestreamStreamKeyHandler(c echo.Context) error {
+	return rotateStreamKey(c, true)
+}
+
+// 配信者のストリームキーの取得API
+// GET /api/user/me/stream_key
+func getUserStreamKeyHandler(c echo.Context) error {
+	return getStreamKey(c, false)
+}
+
+// 配信者のストリームキーの発行API。既存のキーは無効になる
+// POST /api/user/me/stream_key
+func rotateUserStreamKeyHandler(c echo.Context) error {
+	return rotateStreamKey(c, false)
+}
+
+func getStreamKey(c echo.Context, forLivestream bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamID int64
+	if forLivestream {
+		if livestreamID, err = getOwnLivestreamIDParam(c, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	var streamKeyModel StreamKeyModel
+	if err := tx.GetContext(ctx, &streamKeyModel, "SELECT * FROM stream_keys WHERE user_id = ? AND livestream_id = ? AND revoked_at = 0", userID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "stream key has not been issued")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get stream key: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &StreamKey{
+		ID:           streamKeyModel.ID,
+		LivestreamID: streamKeyModel.LivestreamID,
+		KeyPrefix:    streamKeyModel.KeyPrefix,
+		CreatedAt:    streamKeyModel.CreatedAt,
+	})
+}
+
+func rotateStreamKey(c echo.Context, forLivestream bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	key, err := generateStreamKey()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate stream key: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamID int64
+	if forLivestream {
+		if livestreamID, err = getOwnLivestreamIDParam(c, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	// 同時にローテーションされて有効なキーが2つ残らないよう、キーの持ち主の行をロックしてから入れ替える
+	lockQuery, lockID := "SELECT id FROM users WHERE id = ? FOR UPDATE", userID
+	if forLivestream {
+		lockQuery, lockID = "SELECT id FROM livestreams WHERE id = ? FOR UPDATE", livestreamID
+	}
+	var lockedID int64
+	if err := tx.GetContext(ctx, &lockedID, lockQuery, lockID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to lock stream key owner: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "UPDATE stream_keys SET revoked_at = ? WHERE user_id = ? AND livestream_id = ? AND revoked_at = 0", now, userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke stream key: "+err.Error())
+	}
+
+	streamKeyModel := StreamKeyModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		KeyHash:      hashStreamKey(key),
+		KeyPrefix:    key[:streamKeyDisplayLength],
+		CreatedAt:    now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO stream_keys (user_id, livestream_id, key_hash, key_prefix, created_at) VALUES (:user_id, :livestream_id, :key_hash, :key_prefix, :created_at)", streamKeyModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert stream key: "+err.Error())
+	}
+	streamKeyID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted stream key id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, &StreamKey{
+		ID:           streamKeyID,
+		LivestreamID: livestreamID,
+		Key:          key,
+		KeyPrefix:    streamKeyModel.KeyPrefix,
+		CreatedAt:    now,
+	})
+}
+
+// パスの配信が自分のものであることを確認する
+func getOwnLivestreamIDParam(c echo.Context, tx *sqlx.Tx, userID int64) (int64, error) {
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamModel, err := getLivestream(c.Request().Context(), tx, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return 0, echo.NewHTTPError(http.StatusForbidden, "can't manage other streamer's stream key")
+	}
+	if livestreamModel.CanceledAt != 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "the livestream has been canceled")
+	}
+	return livestreamModel.ID, nil
+}
+
+// メディアサーバからの配信開始の認可API
+// 配信枠の時間内であれば、配信IDとともに許可を返す。拒否する場合は403を返す
+// POST /internal/ingest/authorize
+func ingestAuthorizeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if !isIngestRequestAllowed(c.Request()) {
+		return echo.NewHTTPError(http.StatusForbidden, "not allowed to use the ingest API")
+	}
+
+	var req *IngestAuthorizeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StreamKey == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "stream_key is required")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamID, reason, err := authorizeIngest(ctx, tx, req, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to authorize ingest: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if reason != "" {
+		return c.JSON(http.StatusForbidden, &IngestAuthorizeResponse{Authorized: false, Reason: reason})
+	}
+	return c.JSON(http.StatusOK, &IngestAuthorizeResponse{Authorized: true, LivestreamID: livestreamID})
+}
+
+// 認可できない場合は、その理由を返す
+func authorizeIngest(ctx context.Context, tx *sqlx.Tx, req *IngestAuthorizeRequest, now int64) (int64, string, error) {
+	var streamKeyModel StreamKeyModel
+	if err := tx.GetContext(ctx, &streamKeyModel, "SELECT * FROM stream_keys WHERE key_hash = ? AND revoked_at = 0", hashStreamKey(req.StreamKey)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "invalid stream key", nil
+		}
+		return 0, "", err
+	}
+
+	livestreamID := streamKeyModel.LivestreamID
+	if livestreamID == 0 {
+		livestreamID = req.LivestreamID
+	}
+	if req.LivestreamID != 0 && req.LivestreamID != livestreamID {
+		return 0, "the stream key is for another livestream", nil
+	}
+
+	var livestreamModel LivestreamModel
+	if livestreamID == 0 {
+		// 配信者のキーで配信が指定されていなければ、現在配信枠のある配信を選ぶ
+		err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE user_id = ? AND canceled_at = 0 AND start_at <= ? AND ? < end_at ORDER BY start_at LIMIT 1", streamKeyModel.UserID, now, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "no livestream is reserved at this time", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+	} else {
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, "livestream not found", nil
+			}
+			return 0, "", err
+		}
+	}
+
+	switch {
+	case livestreamModel.UserID != streamKeyModel.UserID:
+		return 0, "the stream key is for another streamer", nil
+	case livestreamModel.CanceledAt != 0:
+		return 0, "the livestream has been canceled", nil
+	case now < livestreamModel.StartAt:
+		return 0, "the livestream has not started yet", nil
+	case now >= livestreamModel.EndAt:
+		return 0, "the livestream has already ended", nil
+	}
+	return livestreamModel.ID, "", nil
+}
+
+func generateStreamKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return streamKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// キーは十分に長いランダムな文字列なので、ソルトなしのハッシュで検索できるようにする
+func hashStreamKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// 共有シークレットをヘッダで照合する
+// nginx経由のリクエストは全てループバックから届くので、送信元では判断せず、シークレットが未設定なら全て拒否する
+func isIngestRequestAllowed(r *http.Request) bool {
+	if ingestSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Ingest-Secret")), []byte(ingestSecret)) == 1
+}
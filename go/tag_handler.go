@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const maxTagNameLength = 255
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+	// 親カテゴリのタグID (0は親なし)
+	ParentID int64 `json:"parent_id"`
+}
+
+type UpdateTagRequest struct {
+	Name     *string `json:"name"`
+	ParentID *int64  `json:"parent_id"`
+}
+
+type PostTagAliasRequest struct {
+	Name string `json:"name"`
+}
+
+type TagAlias struct {
+	ID    int64  `json:"id"`
+	TagID int64  `json:"tag_id"`
+	Name  string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// 統合先のタグID
+	Into int64 `json:"into"`
+}
+
+// タグ作成API (管理者のみ)
+// POST /api/admin/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateTagName(req.Name); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := checkTagNameAvailable(ctx, tx, req.Name); err != nil {
+		return err
+	}
+	if req.ParentID != 0 {
+		if _, err := lockTag(ctx, tx, req.ParentID); err != nil {
+			return err
+		}
+	}
+
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tags (name, parent_id) VALUES (?, ?)", req.Name, req.ParentID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	tagModel := TagModel{ID: tagID, Name: req.Name, ParentID: req.ParentID}
+	tagsCache.Store(tagModel.ID, tagModel)
+	tagsByNameCache.Store(tagModel.Name, tagModel)
+
+	return c.JSON(http.StatusCreated, Tag{ID: tagModel.ID, Name: tagModel.Name, ParentID: tagModel.ParentID})
+}
+
+// タグ名・親カテゴリの変更API (管理者のみ)
+// PATCH /api/admin/tag/:tag_id
+func updateTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *UpdateTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name != nil {
+		if err := validateTagName(*req.Name); err != nil {
+			return err
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	oldName := tagModel.Name
+
+	if req.Name != nil && *req.Name != tagModel.Name {
+		if err := checkTagNameAvailable(ctx, tx, *req.Name); err != nil {
+			return err
+		}
+		tagModel.Name = *req.Name
+	}
+	if req.ParentID != nil && *req.ParentID != tagModel.ParentID {
+		if *req.ParentID != 0 {
+			if _, err := lockTag(ctx, tx, *req.ParentID); err != nil {
+				return err
+			}
+			// 自身や子孫を親にすると循環する
+			if containsTagID(tagDescendantIDs(tagModel.ID), *req.ParentID) {
+				return echo.NewHTTPError(http.StatusBadRequest, "can't set the tag itself or its descendant as the parent")
+			}
+		}
+		tagModel.ParentID = *req.ParentID
+	}
+
+	livestreamIDs, err := getTaggedLivestreamIDs(ctx, tx, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ?, parent_id = ? WHERE id = ?", tagModel.Name, tagModel.ParentID, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	tagsByNameCache.Delete(oldName)
+	tagsCache.Store(tagModel.ID, *tagModel)
+	tagsByNameCache.Store(tagModel.Name, *tagModel)
+	// 配信のタグのキャッシュはタグ名を含むので破棄する
+	if oldName != tagModel.Name {
+		for _, livestreamID := range livestreamIDs {
+			livestreamTagsCache.Delete(livestreamID)
+		}
+	}
+
+	return c.JSON(http.StatusOK, Tag{ID: tagModel.ID, Name: tagModel.Name, ParentID: tagModel.ParentID})
+}
+
+// タグ統合API (管理者のみ)
+// 統合元のタグが付いた配信には統合先のタグを付け、統合元のタグは削除する
+// POST /api/admin/tag/:tag_id/merge
+func mergeTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *MergeTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Into == tagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	intoTagModel, err := lockTag(ctx, tx, req.Into)
+	if err != nil {
+		return err
+	}
+
+	livestreamIDs, err := getTaggedLivestreamIDs(ctx, tx, tagModel.ID, intoTagModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	// 両方のタグが付いた配信は、付け替えると重複するので統合元を外すだけにする
+	if _, err := tx.ExecContext(ctx, "DELETE lt FROM livestream_tags lt INNER JOIN livestream_tags dup ON dup.livestream_id = lt.livestream_id AND dup.tag_id = ? WHERE lt.tag_id = ?", intoTagModel.ID, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tag: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", intoTagModel.ID, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tag: "+err.Error())
+	}
+	if err := replaceWaitlistTag(ctx, tx, tagModel.ID, intoTagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation waitlist: "+err.Error())
+	}
+	// 統合元の名前と別名は、統合先の別名として引き続き検索できるようにする
+	if _, err := tx.ExecContext(ctx, "UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", intoTagModel.ID, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag alias: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, name) VALUES (?, ?)", intoTagModel.ID, tagModel.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+	// 統合先が統合元の子孫の場合、子を付け替えると循環するので先に統合元の親に付け替える
+	if containsTagID(tagDescendantIDs(tagModel.ID), intoTagModel.ID) {
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET parent_id = ? WHERE id = ?", tagModel.ParentID, intoTagModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET parent_id = ? WHERE parent_id = ?", intoTagModel.ID, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := evictTagCache(ctx, tagModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+	if err := refreshTaggedLivestreams(ctx, livestreamIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tag index: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, Tag{ID: intoTagModel.ID, Name: intoTagModel.Name})
+}
+
+// タグ削除API (管理者のみ)
+// 配信に付いているタグも外す
+// DELETE /api/admin/tag/:tag_id
+func deleteTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+
+	livestreamIDs, err := getTaggedLivestreamIDs(ctx, tx, tagModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE tag_id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tag: "+err.Error())
+	}
+	if err := replaceWaitlistTag(ctx, tx, tagModel.ID, 0); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation waitlist: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_aliases WHERE tag_id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag alias: "+err.Error())
+	}
+	// 子のタグは削除するタグの親に付け替える
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET parent_id = ? WHERE parent_id = ?", tagModel.ParentID, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := evictTagCache(ctx, tagModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+	if err := refreshTaggedLivestreams(ctx, livestreamIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tag index: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// タグの別名追加API (管理者のみ)
+// POST /api/admin/tag/:tag_id/aliases
+func postTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req *PostTagAliasRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validateTagName(req.Name); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := lockTag(ctx, tx, tagID); err != nil {
+		return err
+	}
+	if err := checkTagNameAvailable(ctx, tx, req.Name); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, name) VALUES (?, ?)", tagID, req.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+	aliasID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag alias id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	aliasModel := TagAliasModel{ID: aliasID, TagID: tagID, Name: req.Name}
+	tagAliasesCache.Store(aliasModel.Name, aliasModel)
+
+	return c.JSON(http.StatusCreated, TagAlias{ID: aliasModel.ID, TagID: aliasModel.TagID, Name: aliasModel.Name})
+}
+
+// タグの別名削除API (管理者のみ)
+// DELETE /api/admin/tag/:tag_id/aliases/:alias_id
+func deleteTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	aliasID, err := strconv.ParseInt(c.Param("alias_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "alias_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var aliasModel TagAliasModel
+	if err := tx.GetContext(ctx, &aliasModel, "SELECT * FROM tag_aliases WHERE id = ? AND tag_id = ? FOR UPDATE", aliasID, tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found tag alias that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag alias: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_aliases WHERE id = ?", aliasModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag alias: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	tagAliasesCache.Delete(aliasModel.Name)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func validateTagName(name string) error {
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxTagNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name is too long")
+	}
+	return nil
+}
+
+// 同じ名前のタグや別名がないか、キャッシュではなくDBで確認する
+func checkTagNameAvailable(ctx context.Context, tx *sqlx.Tx, name string) error {
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM tags WHERE name = ? FOR UPDATE", name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "the tag name is already used")
+	}
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM tag_aliases WHERE name = ? FOR UPDATE", name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag alias: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "the tag name is already used as an alias")
+	}
+	return nil
+}
+
+func lockTag(ctx context.Context, tx *sqlx.Tx, tagID int64) (*TagModel, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return &tagModel, nil
+}
+
+// タグが付いている配信のIDを取得する
+func getTaggedLivestreamIDs(ctx context.Context, tx *sqlx.Tx, tagIDs ...int64) ([]int64, error) {
+	query, params, err := sqlx.In("SELECT DISTINCT livestream_id FROM livestream_tags WHERE tag_id IN (?)", tagIDs)
+	if err != nil {
+		return nil, err
+	}
+	livestreamIDs := []int64{}
+	if err := tx.SelectContext(ctx, &livestreamIDs, query, params...); err != nil {
+		return nil, err
+	}
+	return livestreamIDs, nil
+}
+
+// キャンセル待ちのタグを付け替える (toが0なら外す)
+func replaceWaitlistTag(ctx context.Context, tx *sqlx.Tx, from, to int64) error {
+	var waitlistModels []*ReservationWaitlistModel
+	if err := tx.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE status = ? FOR UPDATE", waitlistStatusWaiting); err != nil {
+		return err
+	}
+
+	for _, waitlistModel := range waitlistModels {
+		var tagIDs []int64
+		if err := json.Unmarshal([]byte(waitlistModel.Tags), &tagIDs); err != nil {
+			return err
+		}
+
+		replaced := make([]int64, 0, len(tagIDs))
+		changed := false
+		for _, tagID := range tagIDs {
+			if tagID == from {
+				changed = true
+				tagID = to
+			}
+			if tagID == 0 || containsTagID(replaced, tagID) {
+				continue
+			}
+			replaced = append(replaced, tagID)
+		}
+		if !changed {
+			continue
+		}
+
+		tagsJSON, err := json.Marshal(replaced)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET tags = ? WHERE id = ?", string(tagsJSON), waitlistModel.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsTagID(tagIDs []int64, tagID int64) bool {
+	for _, id := range tagIDs {
+		if id == tagID {
+			return true
+		}
+	}
+	return false
+}
+
+// 削除したタグをキャッシュから外し、親や別名が変わったタグを読み込み直す
+func evictTagCache(ctx context.Context, tagModel *TagModel) error {
+	tagsCache.Delete(tagModel.ID)
+	tagsByNameCache.Delete(tagModel.Name)
+	tagAliasesCache.Range(func(key, value interface{}) bool {
+		if value.(TagAliasModel).TagID == tagModel.ID {
+			tagAliasesCache.Delete(key)
+		}
+		return true
+	})
+	return loadTagsCache(ctx, dbConn)
+}
+
+// タグの付け替えがあった配信のキャッシュとタグのインデックスを作り直す
+func refreshTaggedLivestreams(ctx context.Context, livestreamIDs []int64) error {
+	for _, livestreamID := range livestreamIDs {
+		livestreamTagsCache.Delete(livestreamID)
+	}
+	if len(livestreamIDs) == 0 {
+		return nil
+	}
+	return livestreamTagIndex.Load(ctx, dbConn)
+}
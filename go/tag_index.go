@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+const (
+	tagSearchModeAnd = "and"
+	tagSearchModeOr  = "or"
+)
+
+// タグ→配信IDの転置インデックス
+// キャンセルされた配信は含めない
+type tagIndex struct {
+	mu sync.RWMutex
+	// タグIDごとの配信ID
+	postings map[int64]map[int64]struct{}
+	// 配信IDごとのタグID (付け替え時に古いタグから外すため)
+	livestreamTags map[int64][]int64
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		postings:       map[int64]map[int64]struct{}{},
+		livestreamTags: map[int64][]int64{},
+	}
+}
+
+// livestream_tagsからインデックスを作り直す
+func (idx *tagIndex) Load(ctx context.Context, tx db) error {
+	var livestreamTags []*LivestreamTagModel
+	if err := tx.SelectContext(ctx, &livestreamTags, "SELECT lt.* FROM livestream_tags lt INNER JOIN livestreams l ON l.id = lt.livestream_id WHERE l.canceled_at = 0"); err != nil {
+		return err
+	}
+
+	postings := map[int64]map[int64]struct{}{}
+	tagsOfLivestream := map[int64][]int64{}
+	for _, lt := range livestreamTags {
+		if _, ok := postings[lt.TagID]; !ok {
+			postings[lt.TagID] = map[int64]struct{}{}
+		}
+		postings[lt.TagID][lt.LivestreamID] = struct{}{}
+		tagsOfLivestream[lt.LivestreamID] = append(tagsOfLivestream[lt.LivestreamID], lt.TagID)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.postings = postings
+	idx.livestreamTags = tagsOfLivestream
+	return nil
+}
+
+// 配信のタグを付け替える
+func (idx *tagIndex) Set(livestreamID int64, tagIDs []int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(livestreamID)
+	for _, tagID := range tagIDs {
+		if _, ok := idx.postings[tagID]; !ok {
+			idx.postings[tagID] = map[int64]struct{}{}
+		}
+		idx.postings[tagID][livestreamID] = struct{}{}
+	}
+	if len(tagIDs) != 0 {
+		idx.livestreamTags[livestreamID] = append([]int64{}, tagIDs...)
+	}
+}
+
+// 配信をインデックスから外す
+func (idx *tagIndex) Remove(livestreamID int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(livestreamID)
+}
+
+func (idx *tagIndex) remove(livestreamID int64) {
+	for _, tagID := range idx.livestreamTags[livestreamID] {
+		delete(idx.postings[tagID], livestreamID)
+		if len(idx.postings[tagID]) == 0 {
+			delete(idx.postings, tagID)
+		}
+	}
+	delete(idx.livestreamTags, livestreamID)
+}
+
+// 配信に付いているタグID
+func (idx *tagIndex) TagsOf(livestreamID int64) []int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.livestreamTags[livestreamID]
+}
+
+// タグIDのグループごとに、グループ内のいずれかのタグを含む配信を求め、
+// 全てのグループに一致する (and) またはいずれかのグループに一致する (or) 配信のIDをIDの降順で返す
+func (idx *tagIndex) Search(tagGroups [][]int64, mode string) []int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	matched := map[int64]int{}
+	for _, tagIDs := range tagGroups {
+		groupMatched := map[int64]struct{}{}
+		for _, tagID := range tagIDs {
+			for livestreamID := range idx.postings[tagID] {
+				groupMatched[livestreamID] = struct{}{}
+			}
+		}
+		for livestreamID := range groupMatched {
+			matched[livestreamID]++
+		}
+	}
+
+	livestreamIDs := make([]int64, 0, len(matched))
+	for livestreamID, count := range matched {
+		if mode == tagSearchModeAnd && count < len(tagGroups) {
+			continue
+		}
+		livestreamIDs = append(livestreamIDs, livestreamID)
+	}
+	sort.Slice(livestreamIDs, func(i, j int) bool { return livestreamIDs[i] > livestreamIDs[j] })
+	return livestreamIDs
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"math"
+)
+
+const (
+	// アップロードできる画像の大きさの上限
+	maxThumbnailBytes  = 10 << 20
+	maxThumbnailPixels = 4096 * 4096
+	minThumbnailSide   = 64
+	// 保存するサムネイルの高さの上限
+	thumbnailMaxHeight   = 720
+	thumbnailJPEGQuality = 85
+)
+
+type thumbnailAspectRatio struct {
+	Width  int
+	Height int
+}
+
+// 元画像に最も近いものへ切り抜く
+var thumbnailAspectRatios = []thumbnailAspectRatio{
+	{Width: 16, Height: 9},
+	{Width: 4, Height: 3},
+	{Width: 1, Height: 1},
+}
+
+type thumbnailImage struct {
+	Image  []byte
+	Hash   string
+	Width  int
+	Height int
+}
+
+// アップロードされた画像を検証し、標準のアスペクト比に切り抜いて縮小したJPEGを返す
+// JPEG・PNG・GIFに対応し、GIFは最初のフレームを使う
+func makeThumbnail(data []byte) (*thumbnailImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("image must be JPEG, PNG or GIF")
+	}
+	if config.Width < minThumbnailSide || config.Height < minThumbnailSide {
+		return nil, errors.New("image is too small")
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, errors.New("image is too large")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("failed to decode image: " + err.Error())
+	}
+
+	b := src.Bounds()
+	ratio := closestThumbnailAspectRatio(b.Dx(), b.Dy())
+
+	// 中央を切り抜き、透過部分は白で塗りつぶす
+	units := min(b.Dx()/ratio.Width, b.Dy()/ratio.Height)
+	cropW, cropH := units*ratio.Width, units*ratio.Height
+	cropMin := b.Min.Add(image.Pt((b.Dx()-cropW)/2, (b.Dy()-cropH)/2))
+	cropped := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	draw.Draw(cropped, cropped.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(cropped, cropped.Bounds(), src, cropMin, draw.Over)
+
+	// 拡大はしない
+	height := min(cropH, thumbnailMaxHeight)
+	units = max(height/ratio.Height, 1)
+	resized := resizeBox(cropped, units*ratio.Width, units*ratio.Height)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return &thumbnailImage{
+		Image:  buf.Bytes(),
+		Hash:   hex.EncodeToString(hash[:]),
+		Width:  resized.Bounds().Dx(),
+		Height: resized.Bounds().Dy(),
+	}, nil
+}
+
+func closestThumbnailAspectRatio(width, height int) thumbnailAspectRatio {
+	closest := thumbnailAspectRatios[0]
+	best := math.Inf(1)
+	for _, ratio := range thumbnailAspectRatios {
+		// 比の対数の差で比べる
+		diff := math.Abs(math.Log(float64(width*ratio.Height) / float64(height*ratio.Width)))
+		if diff < best {
+			closest, best = ratio, diff
+		}
+	}
+	return closest
+}
+
+// 各画素を、対応する元画像の範囲の平均で求める (縮小専用)
+func resizeBox(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// サムネイルのURLは画像ごとに変わるので、ブラウザ側で長めにキャッシュさせる
+	thumbnailCacheControl = "public, max-age=86400"
+	// 公開されていない配信は、共有キャッシュに残さない
+	privateThumbnailCacheControl = "private, max-age=86400"
+)
+
+type LivestreamThumbnailModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Image        []byte `db:"image"`
+	ImageHash    string `db:"image_hash"`
+	Width        int64  `db:"width"`
+	Height       int64  `db:"height"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+type PostThumbnailRequest struct {
+	Image []byte `json:"image"`
+}
+
+type PostThumbnailResponse struct {
+	ThumbnailUrl string `json:"thumbnail_url"`
+	Width        int64  `json:"width"`
+	Height       int64  `json:"height"`
+}
+
+// 配信のサムネイル画像をアップロードし、thumbnail_urlを配信サーバ上の画像に書き換える
+// POST /api/livestream/:livestream_id/thumbnail
+func postThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// 画像の変換は重いので、先に権限を確認しておく
+	livestreamModel, err := getLivestream(ctx, dbConn, livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livestream")
+	}
+
+	var req *PostThumbnailRequest
+	// base64で送られてくるので、その分大きめに読む
+	body := io.LimitReader(c.Request().Body, maxThumbnailBytes/3*4+1024)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.Image) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+	if len(req.Image) > maxThumbnailBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "image is too large")
+	}
+
+	thumbnail, err := makeThumbnail(req.Image)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// キャッシュされたモデルを書き換えないように読み直す
+	livestreamModel = &LivestreamModel{}
+	if err := tx.GetContext(ctx, livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.CanceledAt != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update the canceled livestream")
+	}
+
+	thumbnailModel := LivestreamThumbnailModel{
+		LivestreamID: livestreamModel.ID,
+		Image:        thumbnail.Image,
+		ImageHash:    thumbnail.Hash,
+		Width:        int64(thumbnail.Width),
+		Height:       int64(thumbnail.Height),
+		UpdatedAt:    time.Now().Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_thumbnails (livestream_id, image, image_hash, width, height, updated_at) VALUES (:livestream_id, :image, :image_hash, :width, :height, :updated_at) ON DUPLICATE KEY UPDATE image = VALUES(image), image_hash = VALUES(image_hash), width = VALUES(width), height = VALUES(height), updated_at = VALUES(updated_at)", thumbnailModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert thumbnail: "+err.Error())
+	}
+
+	thumbnailURL := hostedThumbnailURL(livestreamModel.ID, thumbnail.Hash)
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET thumbnail_url = ? WHERE id = ?", thumbnailURL, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	evictLivestreamCache(livestreamModel.ID)
+	thumbnailCache.Store(livestreamModel.ID, &thumbnailModel)
+
+	return c.JSON(http.StatusCreated, &PostThumbnailResponse{
+		ThumbnailUrl: thumbnailURL,
+		Width:        thumbnailModel.Width,
+		Height:       thumbnailModel.Height,
+	})
+}
+
+// 配信のサムネイル画像の取得API
+// 公開配信は未ログインでも取得できる
+// GET /api/livestream/:livestream_id/thumbnail
+func getThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, err := getViewableLivestream(ctx, dbConn, int(livestreamID), getSessionUserID(c))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var thumbnailModel *LivestreamThumbnailModel
+	if cached, ok := thumbnailCache.Load(livestreamID); ok {
+		thumbnailModel = cached.(*LivestreamThumbnailModel)
+	} else {
+		thumbnailModel = &LivestreamThumbnailModel{}
+		if err := dbConn.GetContext(ctx, thumbnailModel, "SELECT * FROM livestream_thumbnails WHERE livestream_id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "not found thumbnail of the livestream")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail: "+err.Error())
+		}
+		thumbnailCache.Store(livestreamID, thumbnailModel)
+	}
+
+	etag := `"` + thumbnailModel.ImageHash + `"`
+	cacheControl := thumbnailCacheControl
+	if livestreamModel.Visibility != livestreamVisibilityPublic {
+		cacheControl = privateThumbnailCacheControl
+	}
+	c.Response().Header().Set("Cache-Control", cacheControl)
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.Blob(http.StatusOK, "image/jpeg", thumbnailModel.Image)
+}
+
+// 画像が変わるとURLも変わるように、ハッシュの先頭をクエリに付ける
+func hostedThumbnailURL(livestreamID int64, hash string) string {
+	return fmt.Sprintf("/api/livestream/%d/thumbnail?v=%s", livestreamID, hash[:16])
+}
+
+// hostedThumbnailURLで作った、この配信にアップロードされた画像のURLか
+// 編集時に今のthumbnail_urlをそのまま送り返せるようにする
+func isHostedThumbnailURL(livestreamID int64, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.IsAbs() || u.Host != "" {
+		return false
+	}
+	return u.Path == fmt.Sprintf("/api/livestream/%d/thumbnail", livestreamID)
+}
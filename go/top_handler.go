@@ -4,24 +4,54 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+const defaultTrendingLimit = 10
+
 type Tag struct {
 	ID   int64  `json:"id"`
 	Name string `json:"name"`
+	// タグ一覧でのみ返す
+	ParentID int64    `json:"parent_id,omitempty"`
+	Aliases  []string `json:"aliases,omitempty"`
 }
 
 type TagModel struct {
-	ID   int64  `db:"id"`
-	Name string `db:"name"`
+	ID       int64  `db:"id"`
+	Name     string `db:"name"`
+	ParentID int64  `db:"parent_id"`
+}
+
+type TagAliasModel struct {
+	ID    int64  `db:"id"`
+	TagID int64  `db:"tag_id"`
+	Name  string `db:"name"`
 }
 
 type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
+type TrendingTag struct {
+	Tag   Tag     `json:"tag"`
+	Score float64 `json:"score"`
+}
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	Score      float64    `json:"score"`
+}
+
+type TrendingResponse struct {
+	Tags        []TrendingTag        `json:"tags"`
+	Livestreams []TrendingLivestream `json:"livestreams"`
+}
+
 func getTagHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -36,6 +66,13 @@ func getTagHandler(c echo.Context) error {
 		tagModels = append(tagModels, value.(TagModel))
 		return true
 	})
+	sort.Slice(tagModels, func(i, j int) bool { return tagModels[i].ID < tagModels[j].ID })
+	aliases := map[int64][]string{}
+	tagAliasesCache.Range(func(key, value interface{}) bool {
+		aliasModel := value.(TagAliasModel)
+		aliases[aliasModel.TagID] = append(aliases[aliasModel.TagID], aliasModel.Name)
+		return true
+	})
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -43,9 +80,12 @@ func getTagHandler(c echo.Context) error {
 
 	tags := make([]*Tag, len(tagModels))
 	for i := range tagModels {
+		sort.Strings(aliases[tagModels[i].ID])
 		tags[i] = &Tag{
-			ID:   tagModels[i].ID,
-			Name: tagModels[i].Name,
+			ID:       tagModels[i].ID,
+			Name:     tagModels[i].Name,
+			ParentID: tagModels[i].ParentID,
+			Aliases:  aliases[tagModels[i].ID],
 		}
 	}
 	return c.JSON(http.StatusOK, &TagsResponse{
@@ -53,6 +93,80 @@ func getTagHandler(c echo.Context) error {
 	})
 }
 
+// 直近で盛り上がっているタグと配信の取得API
+// GET /api/trending?limit=
+func getTrendingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultTrendingLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res := TrendingResponse{
+		Tags:        []TrendingTag{},
+		Livestreams: []TrendingLivestream{},
+	}
+	for _, entry := range trending.TopTags(now) {
+		if len(res.Tags) >= limit {
+			break
+		}
+		tagModel, err := getTagById(ctx, tx, entry.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// 削除・統合されたタグ
+			continue
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+		res.Tags = append(res.Tags, TrendingTag{
+			Tag:   Tag{ID: tagModel.ID, Name: tagModel.Name},
+			Score: entry.Score,
+		})
+	}
+	for _, entry := range trending.TopLivestreams(now) {
+		if len(res.Livestreams) >= limit {
+			break
+		}
+		livestreamModel, err := getLivestream(ctx, tx, int(entry.ID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		// 一覧に表示しない配信は除く
+		if livestreamModel.CanceledAt != 0 || livestreamModel.Visibility != livestreamVisibilityPublic {
+			continue
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		res.Livestreams = append(res.Livestreams, TrendingLivestream{
+			Livestream: livestream,
+			Score:      entry.Score,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
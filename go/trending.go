@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// 盛り上がりのスコアが半分になるまでの秒数
+	trendingHalfLife = 60 * 60
+	// この秒数より前の反応は数えない
+	trendingWindow = 24 * 60 * 60
+
+	trendingReactionWeight    = 1.0
+	trendingLivecommentWeight = 2.0
+	// チップ1あたりの重み
+	trendingTipWeight = 0.01
+)
+
+// 時間とともに指数関数的に減衰するスコア
+type decayScore struct {
+	Score     float64
+	UpdatedAt int64
+}
+
+func (s decayScore) at(now int64) float64 {
+	if now <= s.UpdatedAt {
+		return s.Score
+	}
+	return s.Score * math.Exp2(-float64(now-s.UpdatedAt)/trendingHalfLife)
+}
+
+type trendingEntry struct {
+	ID    int64
+	Score float64
+}
+
+// 配信ごと・タグごとの盛り上がりを、リアクションやライブコメントの投稿時に加算していく
+type trendingCounter struct {
+	mu          sync.Mutex
+	livestreams map[int64]decayScore
+	tags        map[int64]decayScore
+}
+
+func newTrendingCounter() *trendingCounter {
+	return &trendingCounter{
+		livestreams: map[int64]decayScore{},
+		tags:        map[int64]decayScore{},
+	}
+}
+
+func livecommentTrendingWeight(tip int64) float64 {
+	return trendingLivecommentWeight + float64(tip)*trendingTipWeight
+}
+
+// 直近のリアクションとライブコメントからスコアを作り直す
+// タグはlivestreamTagIndexから引くので、先にインデックスを読み込んでおくこと
+func (t *trendingCounter) Load(ctx context.Context, tx db, now int64) error {
+	var reactions []*ReactionModel
+	if err := tx.SelectContext(ctx, &reactions, "SELECT livestream_id, created_at FROM reactions WHERE created_at >= ?", now-trendingWindow); err != nil {
+		return err
+	}
+	var livecomments []*LivecommentModel
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT livestream_id, tip, created_at FROM livecomments WHERE created_at >= ?", now-trendingWindow); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.livestreams = map[int64]decayScore{}
+	t.tags = map[int64]decayScore{}
+	for _, reaction := range reactions {
+		t.record(reaction.LivestreamID, trendingReactionWeight, reaction.CreatedAt, now)
+	}
+	for _, livecomment := range livecomments {
+		t.record(livecomment.LivestreamID, livecommentTrendingWeight(livecomment.Tip), livecomment.CreatedAt, now)
+	}
+	return nil
+}
+
+// 配信と、配信に付いているタグのスコアを加算する
+func (t *trendingCounter) Record(livestreamID int64, weight float64, at int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(livestreamID, weight, at, at)
+}
+
+func (t *trendingCounter) record(livestreamID int64, weight float64, at, now int64) {
+	// 過去の反応は、現在時刻までに減衰した分を差し引いて加算する
+	weight *= decayScore{Score: 1, UpdatedAt: at}.at(now)
+	t.livestreams[livestreamID] = addDecayScore(t.livestreams[livestreamID], weight, now)
+	for _, tagID := range livestreamTagIndex.TagsOf(livestreamID) {
+		t.tags[tagID] = addDecayScore(t.tags[tagID], weight, now)
+	}
+}
+
+func addDecayScore(s decayScore, weight float64, now int64) decayScore {
+	if now < s.UpdatedAt {
+		now = s.UpdatedAt
+	}
+	return decayScore{Score: s.at(now) + weight, UpdatedAt: now}
+}
+
+// 配信をスコアの降順で返す
+func (t *trendingCounter) TopLivestreams(now int64) []trendingEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return rankDecayScores(t.livestreams, now)
+}
+
+// タグをスコアの降順で返す
+func (t *trendingCounter) TopTags(now int64) []trendingEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return rankDecayScores(t.tags, now)
+}
+
+// 窓より前から更新されていないものは捨てる
+func rankDecayScores(scores map[int64]decayScore, now int64) []trendingEntry {
+	entries := make([]trendingEntry, 0, len(scores))
+	for id, s := range scores {
+		if s.UpdatedAt < now-trendingWindow {
+			delete(scores, id)
+			continue
+		}
+		entries = append(entries, trendingEntry{ID: id, Score: s.at(now)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	return entries
+}
@@ -423,6 +423,34 @@ func verifyUserSession(c echo.Context) error {
 	return nil
 }
 
+// 管理者のセッションかを検証する
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	if !adminUsernames[username] {
+		return echo.NewHTTPError(http.StatusForbidden, "only administrators can use this API")
+	}
+
+	return nil
+}
+
+// セッションが有効ならユーザIDを、そうでなければ0を返す
+// ログインしていなくても使えるAPIで、閲覧できる配信を判定するのに使う
+func getSessionUserID(c echo.Context) int64 {
+	if err := verifyUserSession(c); err != nil {
+		return 0
+	}
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	return sess.Values[defaultUserIDKey].(int64)
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	themeModel, err := getThemeByUserId(ctx, tx, userModel.ID)
 	if err != nil {
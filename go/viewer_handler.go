@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type HeartbeatResponse struct {
+	LivestreamViewerCounts
+	// 次のハートビートまでの秒数
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+// 視聴中のハートビートAPI
+// presenceTimeout秒以内に次のハートビートがなければ視聴をやめたものとみなす
+// POST /api/livestream/:livestream_id/heartbeat
+func postHeartbeatHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, err := getViewableLivestream(ctx, dbConn, livestreamID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	if livestreamStatus(*livestreamModel, now) != livestreamStatusLive {
+		return echo.NewHTTPError(http.StatusBadRequest, "the livestream is not live")
+	}
+
+	counts, err := presence.Heartbeat(ctx, dbConn, livestreamModel.ID, userID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to record heartbeat: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &HeartbeatResponse{
+		LivestreamViewerCounts: counts,
+		HeartbeatInterval:      presenceHeartbeatInterval,
+	})
+}
+
+// 配信の同時視聴者数・最大同時視聴者数・ユニーク視聴者数の取得API
+// GET /api/livestream/:livestream_id/viewers
+func getLivestreamViewersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, err := getViewableLivestream(ctx, dbConn, livestreamID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	counts, err := presence.Counts(ctx, dbConn, livestreamModel.ID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewer counts: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, counts)
+}
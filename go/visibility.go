@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 誰でも閲覧でき、一覧・検索にも表示される
+	livestreamVisibilityPublic = "public"
+	// URLを知っていれば閲覧できるが、配信者本人以外の一覧・検索には表示されない
+	livestreamVisibilityUnlisted = "unlisted"
+	// 配信者・承諾済みのコラボレーター・招待されたユーザのみ閲覧できる
+	livestreamVisibilityPrivate = "private"
+)
+
+type LivestreamInviteeModel struct {
+	ID           int64 `db:"id"`
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+	CreatedAt    int64 `db:"created_at"`
+}
+
+// 空の場合は公開として扱う
+func normalizeLivestreamVisibility(visibility string) (string, error) {
+	switch visibility {
+	case "":
+		return livestreamVisibilityPublic, nil
+	case livestreamVisibilityPublic, livestreamVisibilityUnlisted, livestreamVisibilityPrivate:
+		return visibility, nil
+	}
+	return "", echo.NewHTTPError(http.StatusBadRequest, "visibility must be public, unlisted or private")
+}
+
+// ユーザが配信を閲覧できるかを返す。未ログインの場合、userIDは0
+func canViewLivestream(ctx context.Context, tx db, livestreamModel *LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.Visibility != livestreamVisibilityPrivate {
+		return true, nil
+	}
+	if userID == 0 {
+		return false, nil
+	}
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil || canModerate {
+		return canModerate, err
+	}
+	inviteeIDs, err := getLivestreamInviteeIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, inviteeID := range inviteeIDs {
+		if inviteeID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 閲覧できない配信は、存在しない配信と同じくsql.ErrNoRowsを返す
+func getViewableLivestream(ctx context.Context, tx db, livestreamID int, userID int64) (*LivestreamModel, error) {
+	livestreamModel, err := getLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		return nil, err
+	}
+	canView, err := canViewLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !canView {
+		return nil, sql.ErrNoRows
+	}
+	return livestreamModel, nil
+}
+
+// 一覧・検索に表示できる配信の条件を返す
+// tableはlivestreamsテーブル (またはその別名) で、未ログインの場合viewerIDは0
+func listableLivestreamCondition(table string, viewerID int64) (string, []interface{}) {
+	condition := fmt.Sprintf(`(%[1]s.visibility = ? OR %[1]s.user_id = ? OR (%[1]s.visibility = ? AND (
+		EXISTS (SELECT 1 FROM livestream_invitees li WHERE li.livestream_id = %[1]s.id AND li.user_id = ?) OR
+		EXISTS (SELECT 1 FROM livestream_collaborators lc WHERE lc.livestream_id = %[1]s.id AND lc.user_id = ? AND lc.status = ?))))`, table)
+	params := []interface{}{livestreamVisibilityPublic, viewerID, livestreamVisibilityPrivate, viewerID, viewerID, collaboratorStatusAccepted}
+	return condition, params
+}
+
+func getLivestreamInviteeIDs(ctx context.Context, tx db, livestreamID int64) ([]int64, error) {
+	if cached, ok := livestreamInviteesCache.Load(livestreamID); ok {
+		return cached.([]int64), nil
+	}
+
+	userIDs := []int64{}
+	if err := tx.SelectContext(ctx, &userIDs, "SELECT user_id FROM livestream_invitees WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return nil, err
+	}
+	livestreamInviteesCache.Store(livestreamID, userIDs)
+	return userIDs, nil
+}
+
+// 非公開の配信に招待するユーザを置き換える
+// 招待の一覧のキャッシュは、コミットした後にevictLivestreamCacheで破棄する
+func replaceLivestreamInvitees(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, userIDs []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_invitees WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream invitees: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	for _, userID := range userIDs {
+		if userID == livestreamModel.UserID {
+			continue
+		}
+		if _, err := getUserById(ctx, tx, userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invitee %d not found", userID))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		inviteeModel := LivestreamInviteeModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			CreatedAt:    now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_invitees (livestream_id, user_id, created_at) VALUES (:livestream_id, :user_id, :created_at)", inviteeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream invitee: "+err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	waitlistStatusWaiting   = "waiting"
+	waitlistStatusPromoted  = "promoted"
+	waitlistStatusExpired   = "expired"
+	waitlistStatusWithdrawn = "withdrawn"
+)
+
+type ReservationWaitlistModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	Description  string `db:"description"`
+	PlaylistUrl  string `db:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url"`
+	Tags         string `db:"tags"`
+	Visibility   string `db:"visibility"`
+	// 閲覧を許可するユーザIDのJSON配列
+	Invitees string `db:"invitees"`
+	// 登録時に検査したプレイリストの画質ごとの情報のJSON (検査していなければnull)
+	Variants     string `db:"variants"`
+	StartAt      int64  `db:"start_at"`
+	EndAt        int64  `db:"end_at"`
+	DeadlineAt   int64  `db:"deadline_at"`
+	Status       string `db:"status"`
+	LivestreamID int64  `db:"livestream_id"`
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID           int64   `json:"id"`
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	PlaylistUrl  string  `json:"playlist_url"`
+	ThumbnailUrl string  `json:"thumbnail_url"`
+	Tags         []int64 `json:"tags"`
+	Visibility   string  `json:"visibility"`
+	Invitees     []int64 `json:"invitees"`
+	StartAt      int64   `json:"start_at"`
+	EndAt        int64   `json:"end_at"`
+	DeadlineAt   int64   `json:"deadline_at"`
+	Status       string  `json:"status"`
+	// 繰り上がった場合のみ設定される
+	LivestreamID int64 `json:"livestream_id,omitempty"`
+	CreatedAt    int64 `json:"created_at"`
+	UpdatedAt    int64 `json:"updated_at"`
+}
+
+type UpdateReservationSlotsRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 各枠に追加する数
+	Delta int64 `json:"delta"`
+}
+
+type UpdateReservationSlotsResponse struct {
+	// 枠が増えたことで繰り上がった配信のID
+	PromotedLivestreamIDs []int64 `json:"promoted_livestream_ids"`
+}
+
+// キャンセル待ち登録API
+// POST /api/livestream/waitlist
+func joinReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if req.StartAt >= req.EndAt || !isValidReservationTerm(req.StartAt, req.EndAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+	if err := validateLivestreamMediaURLs(req.PlaylistUrl, req.ThumbnailUrl); err != nil {
+		return err
+	}
+	visibility, err := normalizeLivestreamVisibility(req.Visibility)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	deadlineAt := req.StartAt - waitlistDeadline
+	if now >= deadlineAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "the waitlist for the requested time has already closed")
+	}
+	if len(req.Collaborators) != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "collaborators can't be invited from the waitlist")
+	}
+	// 繰り上げ時に同じ画質の情報で配信を作れるよう、登録時に検査しておく
+	variants, err := inspectPlaylist(ctx, req.PlaylistUrl)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	for _, tagID := range req.Tags {
+		if _, err := getTagById(ctx, tx, tagID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "tag not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+	}
+	// 繰り上げ時に失敗しないよう、招待するユーザは登録時に確認する
+	for _, inviteeID := range req.Invitees {
+		if _, err := getUserById(ctx, tx, inviteeID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invitee %d not found", inviteeID))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+	}
+
+	// 空きがあるなら通常の予約を使ってもらう
+	var fullSlots int64
+	if err := tx.GetContext(ctx, &fullSlots, "SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ? AND slot < 1", req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if fullSlots == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "reservation slots are available for the requested time")
+	}
+
+	tags := req.Tags
+	if tags == nil {
+		tags = []int64{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode tags: "+err.Error())
+	}
+	invitees := req.Invitees
+	if invitees == nil {
+		invitees = []int64{}
+	}
+	inviteesJSON, err := json.Marshal(invitees)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode invitees: "+err.Error())
+	}
+	variantsJSON, err := json.Marshal(variants)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode playlist variants: "+err.Error())
+	}
+
+	waitlistModel := ReservationWaitlistModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		Tags:         string(tagsJSON),
+		Visibility:   visibility,
+		Invitees:     string(inviteesJSON),
+		Variants:     string(variantsJSON),
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		DeadlineAt:   deadlineAt,
+		Status:       waitlistStatusWaiting,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, visibility, invitees, variants, start_at, end_at, deadline_at, status, created_at, updated_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :visibility, :invitees, :variants, :start_at, :end_at, :deadline_at, :status, :created_at, :updated_at)", waitlistModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation waitlist: "+err.Error())
+	}
+	waitlistID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation waitlist id: "+err.Error())
+	}
+	waitlistModel.ID = waitlistID
+
+	entry, err := fillReservationWaitlistResponse(waitlistModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reservation waitlist: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// 自分のキャンセル待ち一覧取得API
+// 繰り上がった場合はstatusがpromotedになり、作成された配信のIDが設定される
+// GET /api/livestream/waitlist
+func getMyReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := expireReservationWaitlist(ctx, tx, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to expire reservation waitlist: "+err.Error())
+	}
+
+	var waitlistModels []*ReservationWaitlistModel
+	if err := tx.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	entries := make([]ReservationWaitlistEntry, len(waitlistModels))
+	for i := range waitlistModels {
+		entry, err := fillReservationWaitlistResponse(*waitlistModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reservation waitlist: "+err.Error())
+		}
+		entries[i] = entry
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// キャンセル待ちの取り下げAPI
+// DELETE /api/livestream/waitlist/:entry_id
+func withdrawReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	entryID, err := strconv.ParseInt(c.Param("entry_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "entry_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var waitlistModel ReservationWaitlistModel
+	if err := tx.GetContext(ctx, &waitlistModel, "SELECT * FROM reservation_waitlist WHERE id = ? FOR UPDATE", entryID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found reservation waitlist entry that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+	if waitlistModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't withdraw other streamer's waitlist entry")
+	}
+	if waitlistModel.Status != waitlistStatusWaiting {
+		return echo.NewHTTPError(http.StatusBadRequest, "the waitlist entry has already been "+waitlistModel.Status)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ?", waitlistStatusWithdrawn, time.Now().Unix(), waitlistModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation waitlist: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 予約枠の追加API (管理者のみ)
+// 増えた枠でキャンセル待ちを繰り上げる
+// PUT /api/admin/reservation_slots
+func updateReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *UpdateReservationSlotsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be less than end_at")
+	}
+	if req.Delta < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "delta must be positive")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + ? WHERE start_at >= ? AND end_at <= ?", req.Delta, req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+
+	pendingTags := pendingLivestreamTags{}
+	promotedIDs, err := promoteReservationWaitlist(ctx, tx, req.StartAt, req.EndAt, pendingTags)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to promote reservation waitlist: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	pendingTags.apply()
+
+	return c.JSON(http.StatusOK, UpdateReservationSlotsResponse{PromotedLivestreamIDs: promotedIDs})
+}
+
+// 締め切りを過ぎたキャンセル待ちをexpiredにする
+func expireReservationWaitlist(ctx context.Context, tx *sqlx.Tx, now int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE status = ? AND deadline_at <= ?", waitlistStatusExpired, now, waitlistStatusWaiting, now)
+	return err
+}
+
+// 枠が空いた区間と重なるキャンセル待ちを、登録順に繰り上げる
+// 繰り上がって作成された配信のIDを返し、そのタグはpendingTagsに積む
+func promoteReservationWaitlist(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64, pendingTags pendingLivestreamTags) ([]int64, error) {
+	now := time.Now().Unix()
+	if err := expireReservationWaitlist(ctx, tx, now); err != nil {
+		return nil, err
+	}
+
+	var waitlistModels []*ReservationWaitlistModel
+	if err := tx.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE status = ? AND start_at < ? AND end_at > ? ORDER BY id FOR UPDATE", waitlistStatusWaiting, endAt, startAt); err != nil {
+		return nil, err
+	}
+
+	promotedIDs := []int64{}
+	err := promoteWaitlistInOrder(waitlistModels, func(waitlistModel *ReservationWaitlistModel) error {
+		if err := claimReservationSlots(ctx, tx, waitlistModel.StartAt, waitlistModel.EndAt); err != nil {
+			return err
+		}
+
+		var tagIDs, inviteeIDs []int64
+		if err := json.Unmarshal([]byte(waitlistModel.Tags), &tagIDs); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(waitlistModel.Invitees), &inviteeIDs); err != nil {
+			return err
+		}
+		var variants []PlaylistVariant
+		if err := json.Unmarshal([]byte(waitlistModel.Variants), &variants); err != nil {
+			return err
+		}
+		livestreamModel := &LivestreamModel{
+			UserID:       waitlistModel.UserID,
+			Title:        waitlistModel.Title,
+			Description:  waitlistModel.Description,
+			PlaylistUrl:  waitlistModel.PlaylistUrl,
+			ThumbnailUrl: waitlistModel.ThumbnailUrl,
+			StartAt:      waitlistModel.StartAt,
+			EndAt:        waitlistModel.EndAt,
+			Visibility:   waitlistModel.Visibility,
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel); err != nil {
+			return err
+		}
+		tags, err := insertLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs)
+		if err != nil {
+			return err
+		}
+		pendingTags[livestreamModel.ID] = tags
+		if variants != nil {
+			if err := replaceLivestreamVariants(ctx, tx, livestreamModel.ID, variants); err != nil {
+				return err
+			}
+		}
+		if err := replaceLivestreamInvitees(ctx, tx, livestreamModel, inviteeIDs); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ?, updated_at = ? WHERE id = ?", waitlistStatusPromoted, livestreamModel.ID, now, waitlistModel.ID); err != nil {
+			return err
+		}
+		promotedIDs = append(promotedIDs, livestreamModel.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return promotedIDs, nil
+}
+
+// 登録順 (waitlistModelsの順) にpromoteする
+// 予約できなかった登録と区間が重なる後ろの登録は、同じ枠を待っているので繰り上げない
+// 後ろの短い区間の登録が先頭の登録を追い越すことはなく、重ならない区間の登録はそのまま繰り上がる
+func promoteWaitlistInOrder(waitlistModels []*ReservationWaitlistModel, promote func(*ReservationWaitlistModel) error) error {
+	var blocked []*ReservationWaitlistModel
+	for _, waitlistModel := range waitlistModels {
+		if overlapsWaitlist(waitlistModel, blocked) {
+			// この登録も待たせるので、さらに後ろの登録にも追い越させない
+			blocked = append(blocked, waitlistModel)
+			continue
+		}
+		if err := promote(waitlistModel); err != nil {
+			if errors.Is(err, errReservationSlotUnavailable) {
+				blocked = append(blocked, waitlistModel)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func overlapsWaitlist(waitlistModel *ReservationWaitlistModel, others []*ReservationWaitlistModel) bool {
+	for _, other := range others {
+		if waitlistModel.StartAt < other.EndAt && other.StartAt < waitlistModel.EndAt {
+			return true
+		}
+	}
+	return false
+}
+
+func fillReservationWaitlistResponse(waitlistModel ReservationWaitlistModel) (ReservationWaitlistEntry, error) {
+	var tagIDs, inviteeIDs []int64
+	if err := json.Unmarshal([]byte(waitlistModel.Tags), &tagIDs); err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	if err := json.Unmarshal([]byte(waitlistModel.Invitees), &inviteeIDs); err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+
+	return ReservationWaitlistEntry{
+		ID:           waitlistModel.ID,
+		Title:        waitlistModel.Title,
+		Description:  waitlistModel.Description,
+		PlaylistUrl:  waitlistModel.PlaylistUrl,
+		ThumbnailUrl: waitlistModel.ThumbnailUrl,
+		Tags:         tagIDs,
+		Visibility:   waitlistModel.Visibility,
+		Invitees:     inviteeIDs,
+		StartAt:      waitlistModel.StartAt,
+		EndAt:        waitlistModel.EndAt,
+		DeadlineAt:   waitlistModel.DeadlineAt,
+		Status:       waitlistModel.Status,
+		LivestreamID: waitlistModel.LivestreamID,
+		CreatedAt:    waitlistModel.CreatedAt,
+		UpdatedAt:    waitlistModel.UpdatedAt,
+	}, nil
+}
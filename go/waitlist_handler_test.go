@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPromoteWaitlistInOrderDoesNotOvertakeHead(t *testing.T) {
+	// 先頭は2時間、後ろは1時間の枠を待っていて、1時間分しか空いていない
+	waitlistModels := []*ReservationWaitlistModel{
+		{ID: 1, StartAt: 0, EndAt: 7200},
+		{ID: 2, StartAt: 0, EndAt: 3600},
+	}
+	free := map[int64]bool{0: true}
+
+	var promoted []int64
+	err := promoteWaitlistInOrder(waitlistModels, func(waitlistModel *ReservationWaitlistModel) error {
+		for t := waitlistModel.StartAt; t < waitlistModel.EndAt; t += 3600 {
+			if !free[t] {
+				return errReservationSlotUnavailable
+			}
+		}
+		for t := waitlistModel.StartAt; t < waitlistModel.EndAt; t += 3600 {
+			free[t] = false
+		}
+		promoted = append(promoted, waitlistModel.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(promoted) != 0 {
+		t.Fatalf("later entries must not overtake the head: promoted %v", promoted)
+	}
+}
+
+func TestPromoteWaitlistInOrderPromotesUntilFirstMiss(t *testing.T) {
+	// 全て同じ区間の枠を待っている
+	waitlistModels := []*ReservationWaitlistModel{
+		{ID: 1, StartAt: 0, EndAt: 3600},
+		{ID: 2, StartAt: 0, EndAt: 3600},
+		{ID: 3, StartAt: 0, EndAt: 3600},
+		{ID: 4, StartAt: 0, EndAt: 3600},
+	}
+	fits := map[int64]bool{1: true, 2: true, 3: false, 4: true}
+
+	var promoted []int64
+	err := promoteWaitlistInOrder(waitlistModels, func(waitlistModel *ReservationWaitlistModel) error {
+		if !fits[waitlistModel.ID] {
+			return errReservationSlotUnavailable
+		}
+		promoted = append(promoted, waitlistModel.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(promoted) != 2 || promoted[0] != 1 || promoted[1] != 2 {
+		t.Fatalf("expected [1 2], got %v", promoted)
+	}
+}
+
+func TestPromoteWaitlistInOrderPromotesDisjointEntries(t *testing.T) {
+	// 先頭は0~7200の枠が足りずに待ち、後ろの0~3600はそれを追い越せない
+	// 10800~14400は先頭と同じ枠を待っていないので繰り上がる
+	// 3600~10800は待たされている0~3600の登録とは重ならないが、先頭と重なるので繰り上がらない
+	waitlistModels := []*ReservationWaitlistModel{
+		{ID: 1, StartAt: 0, EndAt: 7200},
+		{ID: 2, StartAt: 0, EndAt: 3600},
+		{ID: 3, StartAt: 10800, EndAt: 14400},
+		{ID: 4, StartAt: 3600, EndAt: 10800},
+	}
+	free := map[int64]bool{0: true, 7200: true, 10800: true}
+
+	var promoted []int64
+	err := promoteWaitlistInOrder(waitlistModels, func(waitlistModel *ReservationWaitlistModel) error {
+		for t := waitlistModel.StartAt; t < waitlistModel.EndAt; t += 3600 {
+			if !free[t] {
+				return errReservationSlotUnavailable
+			}
+		}
+		for t := waitlistModel.StartAt; t < waitlistModel.EndAt; t += 3600 {
+			free[t] = false
+		}
+		promoted = append(promoted, waitlistModel.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(promoted) != 1 || promoted[0] != 3 {
+		t.Fatalf("expected only the disjoint entry [3] to be promoted, got %v", promoted)
+	}
+}
+
+func TestPromoteWaitlistInOrderReturnsOtherErrors(t *testing.T) {
+	want := errors.New("db error")
+	err := promoteWaitlistInOrder([]*ReservationWaitlistModel{{ID: 1}}, func(*ReservationWaitlistModel) error {
+		return want
+	})
+	if !errors.Is(err, want) {
+		t.Fatalf("expected %v, got %v", want, err)
+	}
+}
@@ -1,25 +1,46 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_waitlist;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
+TRUNCATE TABLE tag_aliases;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE livestream_playlist_variants;
+TRUNCATE TABLE livestream_thumbnails;
+TRUNCATE TABLE livestream_invitees;
+TRUNCATE TABLE stream_keys;
+TRUNCATE TABLE livestream_viewer_stats;
+TRUNCATE TABLE livestream_unique_viewers;
+TRUNCATE TABLE watch_logs;
+TRUNCATE TABLE watch_history_clears;
 TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
+ALTER TABLE `tag_aliases` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
+ALTER TABLE `livestream_playlist_variants` auto_increment = 1;
+ALTER TABLE `livestream_thumbnails` auto_increment = 1;
+ALTER TABLE `livestream_invitees` auto_increment = 1;
+ALTER TABLE `stream_keys` auto_increment = 1;
+ALTER TABLE `watch_logs` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
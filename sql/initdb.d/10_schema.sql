@@ -7,7 +7,9 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
-  UNIQUE `uniq_user_name` (`name`)
+  UNIQUE `uniq_user_name` (`name`),
+  -- キーワード検索用 (日本語に対応するためngramパーサを使う)
+  FULLTEXT `ft_users_display_name` (`display_name`) WITH PARSER ngram
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- プロフィール画像
@@ -33,9 +35,122 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  -- 0の場合はキャンセルされていない
+  `canceled_at` BIGINT NOT NULL DEFAULT 0,
+  -- 0の場合は単発の配信
+  `series_id` BIGINT NOT NULL DEFAULT 0,
+  -- public, unlisted, private
+  `visibility` VARCHAR(255) NOT NULL DEFAULT 'public',
+  -- キーワード検索用 (日本語に対応するためngramパーサを使う)
+  FULLTEXT `ft_livestreams_title` (`title`) WITH PARSER ngram,
+  FULLTEXT `ft_livestreams_description` (`description`) WITH PARSER ngram
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のプレイリストに含まれる画質ごとの情報
+CREATE TABLE `livestream_playlist_variants` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `bandwidth` BIGINT NOT NULL,
+  `average_bandwidth` BIGINT NOT NULL DEFAULT 0,
+  `width` BIGINT NOT NULL DEFAULT 0,
+  `height` BIGINT NOT NULL DEFAULT 0,
+  `codecs` VARCHAR(255) NOT NULL DEFAULT '',
+  INDEX `livestream_playlist_variants_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 非公開のライブ配信の閲覧を許可されたユーザ
+CREATE TABLE `livestream_invitees` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_invitee` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信用のストリームキー (ハッシュのみ保存する)
+CREATE TABLE `stream_keys` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- 0の場合は配信者の全ての配信で使える
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `key_hash` VARCHAR(64) NOT NULL,
+  `key_prefix` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  -- 0の場合は有効
+  `revoked_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_stream_key_hash` (`key_hash`),
+  INDEX `stream_keys_user_id_livestream_id` (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ハートビートから求めたライブ配信の視聴者数
+CREATE TABLE `livestream_viewer_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `peak_viewers` BIGINT NOT NULL,
+  `unique_viewers` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信を一度でも視聴したユーザ
+CREATE TABLE `livestream_unique_viewers` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信の視聴記録 (退室しても削除しない)
+CREATE TABLE `watch_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `entered_at` BIGINT NOT NULL,
+  -- 0の場合はまだ退室していない
+  `exited_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `watch_logs_user_id_livestream_id` (`user_id`, `livestream_id`),
+  INDEX `watch_logs_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザが視聴履歴を消去した位置 (このIDまでの視聴記録は履歴に表示しない)
+CREATE TABLE `watch_history_clears` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `cleared_id` BIGINT NOT NULL,
+  `cleared_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信のサムネイル画像
+CREATE TABLE `livestream_thumbnails` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `image` LONGBLOB NOT NULL,
+  `image_hash` VARCHAR(64) NOT NULL,
+  `width` BIGINT NOT NULL,
+  `height` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_thumbnail` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 定期配信のシリーズ
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- weekly
+  `recurrence` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のコラボレーター
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  -- pending, accepted, declined
+  `status` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_collaborator` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX livestream_collaborators_user_id ON livestream_collaborators(`user_id`);
+
 -- ライブ配信予約枠
 CREATE TABLE `reservation_slots` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -44,13 +159,53 @@ CREATE TABLE `reservation_slots` (
   `end_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- 予約枠が埋まっている区間へのキャンセル待ち
+CREATE TABLE `reservation_waitlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  -- タグIDのJSON配列
+  `tags` TEXT NOT NULL,
+  -- public, unlisted, private
+  `visibility` VARCHAR(255) NOT NULL DEFAULT 'public',
+  -- 閲覧を許可するユーザIDのJSON配列
+  `invitees` TEXT NOT NULL,
+  -- 登録時に検査したプレイリストの画質ごとの情報のJSON (検査していなければnull)
+  `variants` TEXT NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  -- この時刻までに繰り上がらなければexpiredになる
+  `deadline_at` BIGINT NOT NULL,
+  -- waiting, promoted, expired, withdrawn
+  `status` VARCHAR(255) NOT NULL,
+  -- 繰り上がった際に作成された配信のID
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX reservation_waitlist_status_start_at ON reservation_waitlist(`status`, `start_at`);
+
 -- ライブストリームに付与される、サービスで定義されたタグ
 CREATE TABLE `tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `name` VARCHAR(255) NOT NULL,
+  -- 親カテゴリのタグID (0は親なし)
+  `parent_id` BIGINT NOT NULL DEFAULT 0,
   UNIQUE `uniq_tag_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- タグの別名 (検索時に正式なタグに読み替える)
+CREATE TABLE `tag_aliases` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `tag_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  UNIQUE `uniq_tag_alias_name` (`name`),
+  INDEX `tag_aliases_tag_id` (`tag_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信とタグの中間テーブル
 CREATE TABLE `livestream_tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,